@@ -0,0 +1,60 @@
+package jingo
+
+// arrayencoder.go manages ArrayEncoder and its responsibilities.
+// Arrays are fixed in length and laid out inline, so unlike slices there's no header to read -
+// each element sits at a known offset from the start of the array. The element instruction is
+// compiled once up-front and then executed for each of them in turn.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// ArrayEncoder stores the instruction for building a JSON document from a fixed-size array at runtime.
+type ArrayEncoder struct {
+	opts   options
+	tt     reflect.Type
+	len    int
+	offset uintptr
+	elem   func(unsafe.Pointer, *Buffer) // writes a single element
+}
+
+// Marshal executes the instruction built up by NewArrayEncoder. s needs to be a pointer to the array.
+func (e *ArrayEncoder) Marshal(s interface{}, w *Buffer) {
+
+	p := (*(*iface)(unsafe.Pointer(&s))).Data
+
+	w.WriteByte('[')
+	for i := 0; i < e.len; i++ {
+		if i > 0 {
+			w.separate()
+		}
+		e.elem(unsafe.Pointer(uintptr(p)+(uintptr(i)*e.offset)), w)
+	}
+	w.WriteByte(']')
+}
+
+// NewArrayEncoder builds a new ArrayEncoder, e.g NewArrayEncoder([4]string{})
+func NewArrayEncoder(t interface{}, opts ...Option) *ArrayEncoder {
+	return newArrayEncoder(t, newOptions(opts))
+}
+
+func newArrayEncoder(t interface{}, o options) *ArrayEncoder {
+	tt := reflect.TypeOf(t)
+
+	/// recursive types share the encoder already being compiled for them
+	if enc, ok := sharedEncoder(tt, &o); ok {
+		return enc.(*ArrayEncoder)
+	}
+
+	e := &ArrayEncoder{opts: o}
+	defer share(tt, o, e)()
+	e.opts.path += "[]" // everything we compile is for the elements
+
+	e.tt = tt
+	e.len = e.tt.Len()
+	e.offset = e.tt.Elem().Size()
+	e.elem = typeInstr(e.tt.Elem(), e.opts)
+
+	return e
+}
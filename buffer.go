@@ -14,7 +14,18 @@ import (
 
 // Buffer is used to pass on to the encoders Marshal methods.
 type Buffer struct {
-	Bytes []byte
+	Bytes  []byte
+	strict bool // set whilst in MarshalE, so that errors from JSONEncoderE and JSONMarshalerE abort the marshal
+
+	// pointers followed by encoders using MaxDepth or DetectCycles, which are yet to be written
+	depth    int
+	visiting []visit
+
+	// set for buffers from NewStreamingBuffer
+	w       io.Writer
+	flushAt int
+	flushed int   // how many bytes have been flushed to w so far
+	err     error // the first error from w, after which nothing more is written to it
 }
 
 var _ io.Writer = &Buffer{} // commit to compatibility with io.Writer
@@ -22,12 +33,18 @@ var _ io.Writer = &Buffer{} // commit to compatibility with io.Writer
 // Write a chunk of bytes to the buffer
 func (b *Buffer) Write(v []byte) (int, error) {
 	b.Bytes = append(b.Bytes, v...)
+	if b.w != nil {
+		b.stream()
+	}
 	return len(v), nil
 }
 
 // WriteString writes a string to the buffer
 func (b *Buffer) WriteString(v string) {
 	b.Bytes = append(b.Bytes, v...)
+	if b.w != nil {
+		b.stream()
+	}
 }
 
 // WriteByte writes a single byte into the output buffer
@@ -80,5 +97,78 @@ func NewBufferFromPoolWithCap(size int) *Buffer {
 // ReturnToPool puts this instance back in the underlying pool. Reading from or using this instance
 // in any way after calling this is invalid.
 func (b *Buffer) ReturnToPool() {
+	b.w, b.err, b.flushed = nil, nil, 0 // so a streaming buffer can't carry on streaming from the pool
 	bufpool.Put(b)
 }
+
+const defaultFlushAt = 32 * 1024
+
+// NewStreamingBuffer returns a Buffer which writes what it holds to w whenever it reaches flushAt bytes, so whole
+// documents needn't be held in memory - e.g when encoding a large slice straight to a file or http.ResponseWriter.
+// It works with every encoder as any other Buffer does. Call Flush once you're done writing to send what's left, and
+// check Err, as the buffer can't report errors from w as they happen. A flushAt of 0 or less uses a default of 32KB.
+//
+// The threshold is checked as chunks and slice or array elements are written rather than for every byte, so the buffer can run a little over it.
+// Streaming buffers aren't pooled.
+func NewStreamingBuffer(w io.Writer, flushAt int) *Buffer {
+	if flushAt <= 0 {
+		flushAt = defaultFlushAt
+	}
+	return &Buffer{Bytes: make([]byte, 0, flushAt+flushAt/4), w: w, flushAt: flushAt}
+}
+
+// Flush writes everything held by a streaming buffer to its writer, emptying the buffer, and returns the first error
+// the writer has returned so far. Once the writer has failed whatever's held is dropped instead. Flush does nothing
+// for buffers which aren't streaming.
+func (b *Buffer) Flush() error {
+	if b.w != nil {
+		b.flush()
+	}
+	return b.err
+}
+
+// separate writes the comma between the elements of a slice or array. It's also where streaming buffers check their
+// threshold, as elements such as numbers are written a byte at a time or through strconv, never going through Write.
+func (b *Buffer) separate() {
+	b.Bytes = append(b.Bytes, ',')
+	if b.w != nil {
+		b.stream()
+	}
+}
+
+// stream flushes a streaming buffer once it's reached its threshold. It's kept out of line so that Write and
+// WriteString stay cheap enough to be inlined themselves.
+//
+//go:noinline
+func (b *Buffer) stream() {
+	if len(b.Bytes) >= b.flushAt {
+		b.flush()
+	}
+}
+
+func (b *Buffer) flush() {
+	if b.err == nil {
+		_, b.err = b.w.Write(b.Bytes)
+	}
+	b.flushed += len(b.Bytes)
+	b.Bytes = b.Bytes[:0]
+}
+
+// Err returns the first error a streaming buffer's writer has returned, if any.
+func (b *Buffer) Err() error {
+	return b.err
+}
+
+// fail reports an error from a field which can fail. Outside of MarshalE there's nobody to tell, so it's dropped.
+func (b *Buffer) fail(err error) {
+	if b.strict {
+		panic(err)
+	}
+}
+
+// extend grows the buffer by n bytes and returns them, so they can be written straight into
+func (b *Buffer) extend(n int) []byte {
+	l := len(b.Bytes)
+	b.Bytes = append(b.Bytes, make([]byte, n)...) // doesn't allocate beyond the growth itself
+	return b.Bytes[l:]
+}
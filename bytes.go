@@ -0,0 +1,55 @@
+package jingo
+
+// bytes.go declares the conversions for []byte. Like encoding/json, byte slices are written as a
+// string in base64 rather than as an array of numbers, with the `,hex` and `,base64url` options
+// there for anything expecting otherwise. Each encodes straight into the buffer's spare capacity.
+
+import (
+	"encoding/base64"
+	"reflect"
+	"unsafe"
+)
+
+var (
+	ptrBase64ToBuf    = bytesInstr(base64Encoder(base64.StdEncoding))
+	ptrBase64URLToBuf = bytesInstr(base64Encoder(base64.RawURLEncoding))
+	ptrHexToBuf       = bytesInstr(hexToBuf)
+)
+
+// isBytes reports whether t, or what t points to, is a byte slice which should be written as a string.
+// As with encoding/json, slices of bytes which serialize themselves are left as arrays.
+func isBytes(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 && marshalerInstr(t.Elem(), options{}) == nil
+}
+
+// bytesInstr creates the instruction for writing the byte slice found at a pointer as a quoted string,
+// with a nil slice written as null
+func bytesInstr(encode func([]byte, *Buffer)) func(unsafe.Pointer, *Buffer) {
+	return func(v unsafe.Pointer, w *Buffer) {
+		b := *(*[]byte)(v)
+		if b == nil {
+			w.Write(null)
+			return
+		}
+		w.WriteByte('"')
+		encode(b, w)
+		w.WriteByte('"')
+	}
+}
+
+func base64Encoder(enc *base64.Encoding) func([]byte, *Buffer) {
+	return func(b []byte, w *Buffer) {
+		enc.Encode(w.extend(enc.EncodedLen(len(b))), b)
+	}
+}
+
+func hexToBuf(b []byte, w *Buffer) {
+	dst := w.extend(len(b) * 2)
+	for i, c := range b {
+		dst[i*2] = hex[c>>4]
+		dst[i*2+1] = hex[c&0x0f]
+	}
+}
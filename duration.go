@@ -0,0 +1,217 @@
+package jingo
+
+// duration.go supports the `,duration=` option, which changes how a time.Duration is written
+// from its default of a number of nanoseconds. Duration.String allocates, so its formatting is
+// mirrored here to write straight into the buffer instead, as is ISO 8601's.
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+	"unsafe"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// durationFormat is how a duration is written. The zero value is the default, a number of nanoseconds.
+type durationFormat int
+
+const (
+	durationNanos durationFormat = iota
+	durationString
+	durationSeconds
+	durationMillis
+	durationISO8601
+)
+
+var durationFormats = map[string]durationFormat{
+	"nanos":   durationNanos,
+	"string":  durationString,
+	"seconds": durationSeconds,
+	"millis":  durationMillis,
+	"iso8601": durationISO8601,
+}
+
+// parseDurationFormat reads the duration format from a field's tag options
+func parseDurationFormat(opts tagOptions, o options) durationFormat {
+	name, ok := opts.Value("duration")
+	if !ok {
+		return durationNanos
+	}
+
+	f, ok := durationFormats[name]
+	if !ok {
+		unsupported(durationType, o, "unknown duration format "+strconv.Quote(name))
+	}
+	return f
+}
+
+// durationInstr creates the instruction for writing the duration found at a pointer in the format f.
+// Numbers are written as they are, everything else is quoted.
+func durationInstr(f durationFormat) func(unsafe.Pointer, *Buffer) {
+	switch f {
+	case durationString:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.WriteByte('"')
+			w.Bytes = appendDurationString(w.Bytes, *(*time.Duration)(v))
+			w.WriteByte('"')
+		}
+	case durationSeconds:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.Bytes = strconv.AppendFloat(w.Bytes, (*(*time.Duration)(v)).Seconds(), 'f', -1, 64)
+		}
+	case durationMillis:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.Bytes = strconv.AppendInt(w.Bytes, (*(*time.Duration)(v)).Milliseconds(), 10)
+		}
+	case durationISO8601:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.WriteByte('"')
+			w.Bytes = appendDurationISO8601(w.Bytes, *(*time.Duration)(v))
+			w.WriteByte('"')
+		}
+	}
+	return ptrInt64ToBuf
+}
+
+// appendDurationString appends d to b in the same form as d.String(), e.g 72h3m0.5s. This is a port of the stdlib's
+// implementation, which formats into a fixed size array from the right.
+func appendDurationString(b []byte, d time.Duration) []byte {
+
+	var buf [32]byte
+	w := len(buf)
+
+	u := uint64(d)
+	neg := d < 0
+	if neg {
+		u = -u
+	}
+
+	if u < uint64(time.Second) {
+		// special case: if duration is smaller than a second, use smaller units, like 1.2ms
+		var prec int
+		w--
+		buf[w] = 's'
+		w--
+		switch {
+		case u == 0:
+			return append(b, "0s"...)
+		case u < uint64(time.Microsecond):
+			prec = 0
+			buf[w] = 'n'
+		case u < uint64(time.Millisecond):
+			prec = 3
+			// U+00B5 'µ' micro sign == 0xC2 0xB5
+			w--
+			copy(buf[w:], "µ")
+		default:
+			prec = 6
+			buf[w] = 'm'
+		}
+		w, u = fmtFrac(buf[:w], u, prec)
+		w = fmtInt(buf[:w], u)
+	} else {
+		w--
+		buf[w] = 's'
+
+		w, u = fmtFrac(buf[:w], u, 9)
+
+		// u is now integer seconds
+		w = fmtInt(buf[:w], u%60)
+		u /= 60
+
+		// u is now integer minutes
+		if u > 0 {
+			w--
+			buf[w] = 'm'
+			w = fmtInt(buf[:w], u%60)
+			u /= 60
+
+			// u is now integer hours
+			if u > 0 {
+				w--
+				buf[w] = 'h'
+				w = fmtInt(buf[:w], u)
+			}
+		}
+	}
+
+	if neg {
+		w--
+		buf[w] = '-'
+	}
+
+	return append(b, buf[w:]...)
+}
+
+// appendDurationISO8601 appends d to b as an ISO 8601 duration, e.g PT1H2M3.5S. Hours are the largest unit
+// used, as days and above vary in length. Negative durations are prefixed with '-'.
+func appendDurationISO8601(b []byte, d time.Duration) []byte {
+
+	u := uint64(d)
+	if d < 0 {
+		u = -u
+		b = append(b, '-')
+	}
+	b = append(b, "PT"...)
+
+	var buf [32]byte
+	w, secs := fmtFrac(buf[:], u, 9) // the fraction of a second, if any
+	frac := buf[w:]
+
+	h, m, s := secs/3600, secs/60%60, secs%60
+	if h > 0 {
+		b = strconv.AppendUint(b, h, 10)
+		b = append(b, 'H')
+	}
+	if m > 0 {
+		b = strconv.AppendUint(b, m, 10)
+		b = append(b, 'M')
+	}
+	if s > 0 || len(frac) > 0 || (h == 0 && m == 0) {
+		b = strconv.AppendUint(b, s, 10)
+		b = append(b, frac...)
+		b = append(b, 'S')
+	}
+
+	return b
+}
+
+// fmtFrac formats the fraction of v/10**prec (e.g., ".12345") into the tail of buf, omitting trailing zeros. It omits
+// the decimal point too when the fraction is 0. It returns the index where the output bytes begin and the value
+// v/10**prec. Ported from the time package.
+func fmtFrac(buf []byte, v uint64, prec int) (nw int, nv uint64) {
+	// Omit trailing zeros up to and including decimal point.
+	w := len(buf)
+	print := false
+	for i := 0; i < prec; i++ {
+		digit := v % 10
+		print = print || digit != 0
+		if print {
+			w--
+			buf[w] = byte(digit) + '0'
+		}
+		v /= 10
+	}
+	if print {
+		w--
+		buf[w] = '.'
+	}
+	return w, v
+}
+
+// fmtInt formats v into the tail of buf. It returns the index where the output begins. Ported from the time package.
+func fmtInt(buf []byte, v uint64) int {
+	w := len(buf)
+	if v == 0 {
+		w--
+		buf[w] = '0'
+	} else {
+		for v > 0 {
+			w--
+			buf[w] = byte(v%10) + '0'
+			v /= 10
+		}
+	}
+	return w
+}
@@ -0,0 +1,103 @@
+package jingo
+
+// dynamic.go handles values whose type can't be known until Marshal runs, i.e interface fields and
+// elements. We still compile an instruction for each concrete type we come across, but we can only
+// do so the first time a type is seen at runtime. Instructions are cached by type so that every
+// value after the first costs a cache lookup on top of a static field.
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// dynamicInstr is a cached instruction for a concrete type found inside an interface
+type dynamicInstr struct {
+	conv   func(unsafe.Pointer, *Buffer)
+	direct bool // the interface's data word is the value itself, rather than a pointer to it
+}
+
+// dynamicCache holds the instructions compiled for each type found under a given set of options, which
+// include the path to the interface so that errors raised from them say where they were found. The cache
+// is resolved at compile time, so at runtime we're only ever looking up a type.
+type dynamicCache struct {
+	o      options
+	instrs sync.Map // reflect.Type -> *dynamicInstr
+}
+
+var dynamicCaches sync.Map // options -> *dynamicCache
+
+func dynamicCacheFor(o options) *dynamicCache {
+	o.compiling = nil // types found at runtime are compiled afresh
+	if c, ok := dynamicCaches.Load(o); ok {
+		return c.(*dynamicCache)
+	}
+
+	c, _ := dynamicCaches.LoadOrStore(o, &dynamicCache{o: o})
+	return c.(*dynamicCache)
+}
+
+// instrFor looks up the instruction for t, compiling it if this is the first time we've seen it
+func (c *dynamicCache) instrFor(t reflect.Type) *dynamicInstr {
+
+	if d, ok := c.instrs.Load(t); ok {
+		return d.(*dynamicInstr)
+	}
+
+	d, _ := c.instrs.LoadOrStore(t, &dynamicInstr{
+		conv:   typeInstr(t, c.o),
+		direct: isDirectIface(t),
+	})
+	return d.(*dynamicInstr)
+}
+
+// ifaceInstr creates the instruction for writing an interface of type t
+func ifaceInstr(t reflect.Type, o options) func(unsafe.Pointer, *Buffer) {
+
+	c := dynamicCacheFor(o)
+
+	/// the type of an empty interface can be read straight from it
+	if t.NumMethod() == 0 {
+		return func(v unsafe.Pointer, w *Buffer) {
+			i := *(*interface{})(v)
+			if i == nil {
+				w.Write(null)
+				return
+			}
+			c.write(reflect.TypeOf(i), v, w)
+		}
+	}
+
+	/// others hold an itab rather than a type, so let reflect find the type for us
+	return func(v unsafe.Pointer, w *Buffer) {
+		rv := reflect.NewAt(t, v).Elem()
+		if rv.IsNil() {
+			w.Write(null)
+			return
+		}
+		c.write(rv.Elem().Type(), v, w)
+	}
+}
+
+// write writes the value held by the interface at v, which we know to be of type t
+func (c *dynamicCache) write(t reflect.Type, v unsafe.Pointer, w *Buffer) {
+	d := c.instrFor(t)
+	if d.direct {
+		d.conv(unsafe.Pointer(&(*iface)(v).Data), w)
+		return
+	}
+	d.conv((*iface)(v).Data, w)
+}
+
+// isDirectIface mirrors the compiler's rules on which types are stored directly in an interface's data word
+func isDirectIface(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	case reflect.Array:
+		return t.Len() == 1 && isDirectIface(t.Elem())
+	case reflect.Struct:
+		return t.NumField() == 1 && isDirectIface(t.Field(0).Type)
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package jingo
+
+// encoder.go provides Encoder, a type-safe front to the other encoders. Their Marshal methods
+// take interface{} and trust that it holds a pointer of the right type, whereas here the compiler
+// checks it for us. Encoder compiles the same instructions as the others, so costs nothing extra.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Encoder writes values of type T as JSON documents. Create one with NewEncoder.
+type Encoder[T any] struct {
+	conv func(unsafe.Pointer, *Buffer)
+}
+
+// NewEncoder builds a new Encoder for T, which can be any type the other encoders support - structs, slices,
+// arrays, maps and primitives alike, e.g jingo.NewEncoder[MyPayload]()
+func NewEncoder[T any](opts ...Option) *Encoder[T] {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	return &Encoder[T]{conv: typeInstr(t, newOptions(opts))}
+}
+
+// Marshal writes v to the buffer provided. A nil v is written as null.
+func (e *Encoder[T]) Marshal(v *T, w *Buffer) {
+	if v == nil {
+		w.Write(null)
+		return
+	}
+	e.conv(unsafe.Pointer(v), w)
+}
@@ -0,0 +1,95 @@
+package jingo
+
+// errors.go declares the errors raised whilst compiling encoders. The compile stage is deeply
+// recursive, so rather than thread errors back through every instruction builder we panic with
+// them, and the constructors which return errors recover them at the top.
+
+import (
+	"reflect"
+)
+
+// UnsupportedTypeError describes a type found whilst compiling an encoder which can't be written as JSON.
+type UnsupportedTypeError struct {
+	Path   string       // where the type was found, e.g Order.Items[].Price. [] marks slice or array elements and {} map values
+	Type   reflect.Type // the type which can't be encoded
+	Reason string       // why it can't be encoded
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path == "" {
+		return "jingo: unsupported type " + e.Type.String() + ": " + e.Reason
+	}
+	return "jingo: unsupported type " + e.Type.String() + " at " + e.Path + ": " + e.Reason
+}
+
+// unsupported aborts compiling with an UnsupportedTypeError for t, found at the path being compiled
+func unsupported(t reflect.Type, o options, reason string) {
+	panic(&UnsupportedTypeError{Path: o.path, Type: t, Reason: reason})
+}
+
+// recoverUnsupported is deferred by the constructors which return errors, to catch an UnsupportedTypeError
+// raised whilst compiling and return it in err. Any other panic is passed on.
+func recoverUnsupported(err *error) {
+	if r := recover(); r != nil {
+		ute, ok := r.(*UnsupportedTypeError)
+		if !ok {
+			panic(r)
+		}
+		*err = ute
+	}
+}
+
+// MarshalerError is returned by MarshalE when a JSONEncoderE or JSONMarshalerE field fails, as does a json.Marshaler or
+// encoding.TextMarshaler, or when one of the checks asked for by MaxDepth or DetectCycles does.
+type MarshalerError struct {
+	Path string       // the field which failed, e.g Order.Items[].Price
+	Type reflect.Type // the type of the field
+	Err  error        // the error it returned, or ErrMaxDepth or ErrCycle
+}
+
+func (e *MarshalerError) Error() string {
+	if e.Path == "" {
+		return "jingo: error encoding " + e.Type.String() + ": " + e.Err.Error()
+	}
+	return "jingo: error encoding " + e.Type.String() + " at " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *MarshalerError) Unwrap() error {
+	return e.Err
+}
+
+// marshalE runs marshal with the buffer in strict mode, so the first *MarshalerError raised unwinds straight back
+// here to be returned
+func marshalE(w *Buffer, marshal func()) (err error) {
+	strict, depth, visiting := w.strict, w.depth, len(w.visiting)
+	w.strict = true
+	defer recoverMarshaler(w, strict, depth, visiting, &err)
+
+	marshal()
+	return nil
+}
+
+// recoverMarshaler is deferred by marshalE to catch a *MarshalerError and return it in err, putting the buffer
+// back as it was found. So is an *UnsupportedTypeError, raised when a type found in an interface at runtime can't be
+// compiled. Any other panic is passed on.
+func recoverMarshaler(w *Buffer, strict bool, depth, visiting int, err *error) {
+	w.strict, w.depth, w.visiting = strict, depth, w.visiting[:visiting]
+	if r := recover(); r != nil {
+		switch e := r.(type) {
+		case *MarshalerError:
+			*err = e
+		case *UnsupportedTypeError:
+			*err = e
+		default:
+			panic(r)
+		}
+	}
+}
+
+// joinPath adds a field name to a path
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
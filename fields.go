@@ -0,0 +1,190 @@
+package jingo
+
+// fields.go works out which fields of a struct get encoded, and under which names. Fields of
+// embedded structs are promoted into their parent in the same way encoding/json does it, so that
+// StructEncoder can compile them straight into the parent's instruction set.
+
+import (
+	"reflect"
+	"sort"
+)
+
+// field is a single field to be encoded, as found by typeFields
+type field struct {
+	name   string
+	tagged bool       // name came from the json tag
+	index  []int      // index sequence for reflect.Type.FieldByIndex
+	opts   tagOptions // options from the json tag
+	sf     reflect.StructField
+
+	// ptrs are the offsets of any embedded struct pointers which need following to reach the field, outermost first.
+	// Each one is relative to the struct found at the previous pointer, as is sf.Offset to the last one.
+	ptrs []uintptr
+}
+
+// embedded is an embedded struct queued up for typeFields to visit
+type embedded struct {
+	t      reflect.Type
+	index  []int
+	offset uintptr
+	ptrs   []uintptr
+	dup    bool // the struct was found more than once at this depth
+}
+
+// typeFields returns the fields to be encoded for the struct type t, in the order they should be written.
+// Only tagged fields are included, along with those promoted from untagged embedded structs and struct pointers, unless
+// o.untagged is set - then the fields are picked as encoding/json picks them, see StdlibFields. Names which don't come
+// from a tag are derived from the Go name as per o.naming.
+// When names collide the shallowest field wins, then a tagged field over an untagged one, otherwise they're all dropped.
+func typeFields(t reflect.Type, o options) []field {
+
+	var fields []field
+
+	next := []embedded{{t: t}}
+	visited := map[reflect.Type]bool{}
+
+	// walk the embedded structs breadth first, so each pass over 'next' is one level deeper
+	for len(next) > 0 {
+		var queue []embedded
+		count := map[reflect.Type]int{}
+
+		for _, emb := range next {
+			if visited[emb.t] {
+				continue
+			}
+			visited[emb.t] = true
+
+			for i := 0; i < emb.t.NumField(); i++ {
+				sf := emb.t.Field(i)
+
+				tag := sf.Tag.Get("json")
+				name, opts := parseTag(tag)
+
+				/// the stdlib leaves out fields tagged "-" and unexported fields, bar embedded structs which may
+				/// have exported fields of their own to promote
+				if o.untagged {
+					if tag == "-" {
+						continue
+					}
+					if !sf.IsExported() && !(sf.Anonymous && isStructOrPtr(sf.Type)) {
+						continue
+					}
+				}
+
+				index := make([]int, len(emb.index)+1)
+				copy(index, emb.index)
+				index[len(emb.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				/// untagged embedded structs are flattened into their parent
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					inner := embedded{t: ft, index: index, offset: emb.offset + sf.Offset, ptrs: emb.ptrs}
+					if sf.Type.Kind() == reflect.Ptr {
+						inner.ptrs = append(append([]uintptr(nil), emb.ptrs...), emb.offset+sf.Offset)
+						inner.offset = 0
+					}
+
+					count[ft]++
+					if count[ft] == 1 {
+						queue = append(queue, inner)
+					}
+					continue
+				}
+
+				tagged := name != ""
+				if !tagged {
+					if !o.untagged {
+						continue
+					}
+					name = o.naming.name(sf.Name)
+				}
+
+				sf.Offset += emb.offset
+				fields = append(fields, field{
+					name:   name,
+					tagged: tagged,
+					index:  index,
+					opts:   opts,
+					sf:     sf,
+					ptrs:   emb.ptrs,
+				})
+
+				// a struct embedded more than once at the same depth annihilates its own fields, so make sure
+				// the dominance pass below sees the duplicate
+				if emb.dup {
+					fields = append(fields, fields[len(fields)-1])
+				}
+			}
+		}
+
+		for i := range queue {
+			queue[i].dup = count[queue[i].t] > 1
+		}
+		next = queue
+	}
+
+	// sort by name, then depth, then whether the name came from a tag, then index sequence
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		if a.tagged != b.tagged {
+			return a.tagged
+		}
+		return indexLess(a.index, b.index)
+	})
+
+	// drop the fields hidden by the dominance rules
+	out := fields[:0]
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].name != fields[i].name {
+				break
+			}
+		}
+
+		if advance == 1 {
+			out = append(out, fields[i])
+			continue
+		}
+
+		// the first field dominates unless the next one is just as shallow and just as tagged
+		if a, b := fields[i], fields[i+1]; len(a.index) != len(b.index) || a.tagged != b.tagged {
+			out = append(out, a)
+		}
+	}
+	fields = out
+
+	// and back to the order they're declared in
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].index, fields[j].index)
+	})
+
+	return fields
+}
+
+// isStructOrPtr reports whether t is a struct, or a pointer to one
+func isStructOrPtr(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// indexLess orders two index sequences as their fields are declared
+func indexLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,95 @@
+package jingo
+
+// guard.go protects against pointer graphs which would otherwise have Marshal recurse until the
+// stack runs out - data cycles like doubly linked lists or parent back-pointers, or chains which
+// are simply too deep. The checks are opt-in and wrap the instructions which follow pointers to
+// composite values, so encoders which don't ask for them compile exactly as they always have.
+
+import (
+	"errors"
+	"reflect"
+	"unsafe"
+)
+
+var (
+	// ErrMaxDepth is the error within the *MarshalerError returned by MarshalE when more pointers need following than
+	// MaxDepth allows
+	ErrMaxDepth = errors.New("maximum depth exceeded")
+
+	// ErrCycle is the error within the *MarshalerError returned by MarshalE when DetectCycles finds a pointer back to
+	// a value still being written
+	ErrCycle = errors.New("pointer cycle detected")
+)
+
+// MaxDepth limits how many pointers deep the encoder will follow, counting only pointers to structs, slices, arrays
+// and maps. Anything deeper is written as null by Marshal, whilst MarshalE stops and returns an error wrapping
+// ErrMaxDepth which names the field. This protects against data too deep to write, cyclic or otherwise.
+func MaxDepth(n int) Option {
+	return func(o *options) {
+		o.maxDepth = n
+	}
+}
+
+// DetectCycles makes the encoder check every pointer it follows to a struct, slice, array or map against those it's
+// still in the middle of writing. A pointer back to one of them is written as null by Marshal, whilst MarshalE stops
+// and returns an error wrapping ErrCycle which names the field. The value passed to Marshal wasn't reached through a
+// pointer, so a cycle back to it is caught a step later. Each check is a search through the pointers being written,
+// so pairing this with MaxDepth keeps the cost down for deep data.
+func DetectCycles() Option {
+	return func(o *options) {
+		o.detectCycles = true
+	}
+}
+
+// visit is a value being written which was reached through a pointer. The type is kept as a struct and its first
+// field share an address.
+type visit struct {
+	p unsafe.Pointer
+	t reflect.Type
+}
+
+// guardInstr wraps conv, which writes the value of type t found at a pointer which has just been followed, in the
+// checks asked for by MaxDepth and DetectCycles. conv is returned as it is when neither were asked for, or when t
+// isn't a type which can lead any deeper.
+func guardInstr(t reflect.Type, o options, conv func(unsafe.Pointer, *Buffer)) func(unsafe.Pointer, *Buffer) {
+
+	if o.maxDepth == 0 && !o.detectCycles {
+		return conv
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+	default:
+		return conv
+	}
+
+	path, maxDepth, detectCycles := o.path, o.maxDepth, o.detectCycles
+
+	return func(v unsafe.Pointer, w *Buffer) {
+
+		if maxDepth > 0 && w.depth >= maxDepth {
+			w.Write(null)
+			w.fail(&MarshalerError{Path: path, Type: t, Err: ErrMaxDepth})
+			return
+		}
+
+		if detectCycles {
+			for _, vis := range w.visiting {
+				if vis.p == v && vis.t == t {
+					w.Write(null)
+					w.fail(&MarshalerError{Path: path, Type: t, Err: ErrCycle})
+					return
+				}
+			}
+			w.visiting = append(w.visiting, visit{v, t})
+		}
+
+		w.depth++
+		conv(v, w)
+		w.depth--
+
+		if detectCycles {
+			w.visiting = w.visiting[:len(w.visiting)-1]
+		}
+	}
+}
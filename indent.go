@@ -0,0 +1,119 @@
+package jingo
+
+// indent.go supports MarshalIndent. Rather than compile a second set of instructions for indented
+// output, the compact document is written as normal and then indented in a single pass over it,
+// tracking the depth as we go. This leaves the instructions behind Marshal exactly as they are,
+// and as indenting is usually wanted for debugging or config dumps the extra pass is a fair price.
+
+import (
+	"bytes"
+)
+
+// MarshalIndent is Marshal, but writes the document with each element on a new line beginning with prefix followed
+// by one or more copies of indent according to its nesting, in the same way as json.MarshalIndent.
+func (e *StructEncoder) MarshalIndent(s interface{}, w *Buffer, prefix, indent string) {
+	buf := NewBufferFromPool()
+	e.Marshal(s, buf)
+	indentToBuf(buf.Bytes, w, prefix, indent)
+	buf.ReturnToPool()
+}
+
+// MarshalIndent is Marshal, but writes the document with each element on a new line beginning with prefix followed
+// by one or more copies of indent according to its nesting, in the same way as json.MarshalIndent.
+func (e *SliceEncoder) MarshalIndent(s interface{}, w *Buffer, prefix, indent string) {
+	buf := NewBufferFromPool()
+	e.Marshal(s, buf)
+	indentToBuf(buf.Bytes, w, prefix, indent)
+	buf.ReturnToPool()
+}
+
+// indentToBuf writes the JSON document src to w indented as per MarshalIndent. Whitespace between tokens in src is
+// dropped, and empty objects and arrays are left as {} and []. Runs of bytes which need no changes are copied as one.
+func indentToBuf(src []byte, w *Buffer, prefix, indent string) {
+
+	depth := 0
+	start := 0    // start of the run of bytes waiting to be copied
+	open := false // we've just opened an object or array, so don't yet know if it's empty
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			w.Write(src[start:i])
+			start = i + 1
+			continue
+		}
+
+		/// the first element of an object or array goes on a new line, one level deeper
+		if open && c != '}' && c != ']' {
+			open = false
+			depth++
+			w.Write(src[start:i])
+			start = i
+			newline(w, prefix, indent, depth)
+		}
+
+		switch c {
+		case '"':
+			// strings are copied as they are, so skip to the closing quote
+			i = closingQuote(src, i)
+
+		case '{', '[':
+			open = true
+
+		case ',':
+			w.Write(src[start : i+1])
+			start = i + 1
+			newline(w, prefix, indent, depth)
+
+		case ':':
+			w.Write(src[start : i+1])
+			start = i + 1
+			w.WriteByte(' ')
+
+		case '}', ']':
+			if open {
+				open = false // empty, so stays on the same line
+			} else if depth > 0 {
+				depth--
+				w.Write(src[start:i])
+				start = i
+				newline(w, prefix, indent, depth)
+			}
+		}
+	}
+
+	if start < len(src) {
+		w.Write(src[start:])
+	}
+}
+
+// closingQuote returns the index of the quote closing the string opened at src[i], or len(src) if there isn't one
+func closingQuote(src []byte, i int) int {
+	for {
+		j := bytes.IndexByte(src[i+1:], '"')
+		if j < 0 {
+			return len(src)
+		}
+		i += j + 1
+
+		// the quote is escaped if it follows an odd number of backslashes
+		n := 0
+		for k := i - 1; src[k] == '\\'; k-- {
+			n++
+		}
+		if n%2 == 0 {
+			return i
+		}
+	}
+}
+
+// newline starts a new line at the given depth
+func newline(w *Buffer, prefix, indent string, depth int) {
+	w.WriteByte('\n')
+	w.WriteString(prefix)
+	for i := 0; i < depth; i++ {
+		w.WriteString(indent)
+	}
+}
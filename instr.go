@@ -0,0 +1,106 @@
+package jingo
+
+// instr.go builds standalone instructions for writing a single value of a given type.
+// StructEncoder and SliceEncoder compile their own specialised instructions from the field or
+// element they're working with; typeInstr is for the places where a value needs writing on its
+// own, like the values held in a map. Composite types are handed off to their own encoders.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// typeInstr returns an instruction which writes the value of type t found at a pointer.
+func typeInstr(t reflect.Type, o options) func(unsafe.Pointer, *Buffer) {
+
+	/// conversions registered for the type come before any we'd pick
+	if conv := typeEncoderFor(t); conv != nil {
+		return conv
+	}
+
+	// see if we can select based on a specific type
+	switch t {
+	case timeType:
+		if o.time != (timeFormat{}) {
+			return timeInstr(o.time)
+		}
+		return quotedInstr(ptrTimeToBuf)
+	case durationType:
+		if o.duration != durationNanos {
+			return durationInstr(o.duration)
+		}
+	case htmlEscapeStringType:
+		return quotedInstr(ptrHTMLEscapeStringToBuf)
+	case escapeStringType:
+		if o.escapeHTML {
+			return quotedInstr(ptrHTMLEscapeStringToBuf)
+		}
+		return quotedInstr(ptrEscapeStringToBuf)
+	}
+
+	/// types which serialize themselves
+	if conv := marshalerInstr(t, o); conv != nil {
+		return conv
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if o.escapeHTML {
+			return quotedInstr(ptrHTMLEscapeStringToBuf)
+		}
+		return quotedInstr(ptrStringToBuf)
+
+	case reflect.Struct:
+		enc := newStructEncoder(reflect.New(t).Elem().Interface(), o)
+		return func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		}
+
+	case reflect.Slice:
+		enc := newSliceEncoder(reflect.New(t).Elem().Interface(), o)
+		return func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		}
+
+	case reflect.Array:
+		enc := newArrayEncoder(reflect.New(t).Elem().Interface(), o)
+		return func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		}
+
+	case reflect.Map:
+		enc := newMapEncoder(reflect.New(t).Elem().Interface(), o)
+		return func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		}
+
+	case reflect.Interface:
+		return ifaceInstr(t, o)
+
+	case reflect.Ptr:
+		conv := guardInstr(t.Elem(), o, typeInstr(t.Elem(), o))
+		return func(v unsafe.Pointer, w *Buffer) {
+			p := *(*unsafe.Pointer)(v)
+			if p == nil {
+				w.Write(null)
+				return
+			}
+			conv(p, w)
+		}
+	}
+
+	conv, ok := typeconv[t.Kind()]
+	if !ok {
+		unsupported(t, o, "no JSON representation for kind "+t.Kind().String())
+	}
+	return conv
+}
+
+// quotedInstr wraps conv so that whatever it writes is surrounded by quotes
+func quotedInstr(conv func(unsafe.Pointer, *Buffer)) func(unsafe.Pointer, *Buffer) {
+	return func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('"')
+		conv(v, w)
+		w.WriteByte('"')
+	}
+}
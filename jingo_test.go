@@ -3,12 +3,17 @@ package jingo
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"net/netip"
 	"reflect"
 	"strconv"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 type all struct {
@@ -745,3 +750,2804 @@ func NewLargePayload() *LargePayload {
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func Test_OmitEmpty(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+
+	type omitEmpty struct {
+		Str    string    `json:"str,omitempty"`
+		Int    int       `json:"int,omitempty"`
+		Float  float64   `json:"float,omitempty"`
+		Bool   bool      `json:"bool,omitempty"`
+		Ptr    *string   `json:"ptr,omitempty"`
+		Slice  []string  `json:"slice,omitempty"`
+		Inner  inner     `json:"inner,omitempty"`
+		Time   time.Time `json:"time,omitempty"`
+		Always string    `json:"always"`
+		Last   int8      `json:"last,omitempty"`
+	}
+
+	str := "s"
+
+	tests := []struct {
+		name string
+		v    omitEmpty
+		want string
+	}{
+		{
+			"All empty",
+			omitEmpty{},
+			`{"always":""}`,
+		},
+		{
+			"Empty but not nil slice",
+			omitEmpty{Slice: []string{}},
+			`{"always":""}`,
+		},
+		{
+			"Leading field written",
+			omitEmpty{Str: "a", Always: "b"},
+			`{"str":"a","always":"b"}`,
+		},
+		{
+			"Trailing field written",
+			omitEmpty{Last: 1},
+			`{"always":"","last":1}`,
+		},
+		{
+			"All written",
+			omitEmpty{
+				Str:    "a",
+				Int:    1,
+				Float:  1.5,
+				Bool:   true,
+				Ptr:    &str,
+				Slice:  []string{"b"},
+				Inner:  inner{Age: 2},
+				Time:   time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC),
+				Always: "c",
+				Last:   3,
+			},
+			`{"str":"a","int":1,"float":1.5,"bool":true,"ptr":"s","slice":["b"],"inner":{"name":"","age":2},"time":"2000-09-17T20:04:26Z","always":"c","last":3}`,
+		},
+	}
+
+	enc := NewStructEncoder(omitEmpty{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			enc.Marshal(&tt.v, buf)
+
+			if tt.want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_OmitEmptyOnly(t *testing.T) {
+
+	type omitEmptyOnly struct {
+		A string `json:"a,omitempty"`
+		B int    `json:"b,omitempty"`
+		C bool   `json:"c,omitempty"`
+	}
+
+	tests := []struct {
+		v    omitEmptyOnly
+		want string
+	}{
+		{omitEmptyOnly{}, `{}`},
+		{omitEmptyOnly{A: "a"}, `{"a":"a"}`},
+		{omitEmptyOnly{B: 1}, `{"b":1}`},
+		{omitEmptyOnly{B: 1, C: true}, `{"b":1,"c":true}`},
+		{omitEmptyOnly{A: "a", C: true}, `{"a":"a","c":true}`},
+	}
+
+	enc := NewStructEncoder(omitEmptyOnly{})
+
+	for _, tt := range tests {
+		buf := NewBufferFromPool()
+		enc.Marshal(&tt.v, buf)
+
+		if tt.want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+		}
+
+		buf.ReturnToPool()
+	}
+}
+
+type textKey struct {
+	a, b string
+}
+
+func (k textKey) MarshalText() ([]byte, error) {
+	return []byte(k.a + "-" + k.b), nil
+}
+
+func TestMapEncoder(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	tests := []struct {
+		name string
+		enc  *MapEncoder
+		v    interface{}
+		want string
+	}{
+		{
+			"MapEncoder String - Nil",
+			NewMapEncoder(map[string]string{}),
+			new(map[string]string),
+			`null`,
+		},
+		{
+			"MapEncoder String - Empty",
+			NewMapEncoder(map[string]string{}),
+			&map[string]string{},
+			`{}`,
+		},
+		{
+			"MapEncoder String - Sorted",
+			NewMapEncoder(map[string]string{}),
+			&map[string]string{"b": "2", "a": "1", "c": "3", "ab": "4"},
+			`{"a":"1","ab":"4","b":"2","c":"3"}`,
+		},
+		{
+			"MapEncoder Int keys",
+			NewMapEncoder(map[int]float64{}),
+			&map[int]float64{10: 1.5, -1: 2, 9: 3},
+			`{"-1":2,"10":1.5,"9":3}`,
+		},
+		{
+			"MapEncoder TextMarshaler keys",
+			NewMapEncoder(map[textKey]bool{}),
+			&map[textKey]bool{{"a", "b"}: true},
+			`{"a-b":true}`,
+		},
+		{
+			"MapEncoder Struct values",
+			NewMapEncoder(map[string]inner{}),
+			&map[string]inner{"x": {"y"}},
+			`{"x":{"name":"y"}}`,
+		},
+		{
+			"MapEncoder Pointer values",
+			NewMapEncoder(map[string]*inner{}),
+			&map[string]*inner{"x": {"y"}, "z": nil},
+			`{"x":{"name":"y"},"z":null}`,
+		},
+		{
+			"MapEncoder Slice values",
+			NewMapEncoder(map[string][]int{}),
+			&map[string][]int{"x": {1, 2}},
+			`{"x":[1,2]}`,
+		},
+		{
+			"MapEncoder Time values",
+			NewMapEncoder(map[string]time.Time{}),
+			&map[string]time.Time{"x": time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC)},
+			`{"x":"2000-09-17T20:04:26Z"}`,
+		},
+		{
+			"MapEncoder Nested",
+			NewMapEncoder(map[string]map[uint8]string{}),
+			&map[string]map[uint8]string{"x": {1: "a"}, "y": nil},
+			`{"x":{"1":"a"},"y":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			tt.enc.Marshal(tt.v, buf)
+
+			if tt.want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_MapKeyOrder(t *testing.T) {
+
+	// keys are sorted as they are rather than once escaped, as encoding/json does
+	m := map[string]int{"<": 1, "Z": 2, "\"": 3, "\x01": 4, "a": 5, "\\": 6}
+
+	for _, opts := range [][]Option{nil, {EscapeHTML()}} {
+		buf := NewBufferFromPool()
+		NewMapEncoder(map[string]int{}, opts...).Marshal(&m, buf)
+
+		want := bytes.Buffer{}
+		je := json.NewEncoder(&want)
+		je.SetEscapeHTML(len(opts) > 0)
+		je.Encode(m)
+
+		if want := string(bytes.TrimSuffix(want.Bytes(), []byte("\n"))); want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_MapFields(t *testing.T) {
+
+	type mapFields struct {
+		Map      map[string]int    `json:"map"`
+		NilMap   map[string]int    `json:"nilMap"`
+		PtrMap   *map[string]int   `json:"ptrMap"`
+		Omit     map[string]int    `json:"omit,omitempty"`
+		SliceMap []map[string]int  `json:"sliceMap"`
+		SlicePtr []*map[string]int `json:"slicePtr"`
+	}
+
+	m := map[string]int{"a": 1}
+	v := mapFields{
+		Map:      map[string]int{"b": 2, "a": 1},
+		PtrMap:   &m,
+		Omit:     map[string]int{},
+		SliceMap: []map[string]int{{"a": 1}, nil},
+		SlicePtr: []*map[string]int{&m, nil},
+	}
+
+	enc := NewStructEncoder(mapFields{})
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&v, buf)
+
+	want, _ := json.Marshal(v)
+	if string(want) != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func BenchmarkMap(b *testing.B) {
+	b.ReportAllocs()
+
+	m := map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}
+	enc := NewMapEncoder(map[string]int{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&m, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkMapStdLib(b *testing.B) {
+	b.ReportAllocs()
+
+	m := map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(&m)
+	}
+}
+
+type stringer interface {
+	String() string
+}
+
+type stringerImpl struct {
+	Val string `json:"val"`
+}
+
+func (s stringerImpl) String() string {
+	return s.Val
+}
+
+func Test_Interface(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	type envelope struct {
+		Data     interface{}   `json:"data"`
+		Nil      interface{}   `json:"nil"`
+		Items    []interface{} `json:"items"`
+		Stringer stringer      `json:"stringer"`
+		NilStr   stringer      `json:"nilStringer"`
+		Omit     interface{}   `json:"omit,omitempty"`
+	}
+
+	tests := []struct {
+		name string
+		v    envelope
+	}{
+		{
+			"Nil",
+			envelope{Items: []interface{}{}},
+		},
+		{
+			"Primitives",
+			envelope{
+				Data:  "a string",
+				Items: []interface{}{1, int8(2), uint64(3), 4.5, true, "six", nil},
+			},
+		},
+		{
+			"Structs",
+			envelope{
+				Data:     inner{"by value"},
+				Items:    []interface{}{&inner{"by pointer"}, (*inner)(nil), struct{}{}},
+				Stringer: stringerImpl{"stringer"},
+				Omit:     &stringerImpl{"stringer pointer"},
+			},
+		},
+		{
+			"Composites",
+			envelope{
+				Data: map[string]interface{}{
+					"a": []interface{}{"b", map[string]interface{}{"c": 1}},
+					"d": []string{"e"},
+					"f": map[string]int{"g": 1},
+				},
+				Items: []interface{}{time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC), []int{1}},
+			},
+		},
+	}
+
+	enc := NewStructEncoder(envelope{})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			enc.Marshal(&tt.v, buf)
+
+			want, _ := json.Marshal(&tt.v)
+			if string(want) != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_InterfaceConcurrent(t *testing.T) {
+
+	type concurrent struct {
+		A int `json:"a"`
+	}
+
+	enc := NewSliceEncoder([]interface{}{})
+	v := []interface{}{concurrent{1}, &concurrent{2}, map[string]concurrent{"b": {3}}}
+	want := `[{"a":1},{"a":2},{"b":{"a":3}}]`
+
+	done := make(chan string)
+	for i := 0; i < 8; i++ {
+		go func() {
+			buf := NewBufferFromPool()
+			enc.Marshal(&v, buf)
+			done <- buf.String()
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if got := <-done; got != want {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func BenchmarkInterface(b *testing.B) {
+	b.ReportAllocs()
+
+	type payload struct {
+		Data interface{} `json:"data"`
+	}
+
+	v := payload{Data: smallPayload}
+	enc := NewStructEncoder(payload{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		enc.Marshal(&v, buf)
+		buf.ReturnToPool()
+	}
+}
+
+type EmbeddedBase struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type EmbeddedAudit struct {
+	Created string `json:"created"`
+	Name    string `json:"name"` // same depth as EmbeddedBase.Name, so both are dropped
+}
+
+type embeddedDeep struct {
+	EmbeddedBase
+	Deep string `json:"deep"`
+}
+
+type EmbeddedPtr struct {
+	Ptr string `json:"ptr"`
+	*embeddedDeep
+}
+
+func Test_Embedded(t *testing.T) {
+
+	type embedded struct {
+		EmbeddedBase
+		Tagged EmbeddedBase `json:"tagged"`
+		Own    string       `json:"own"`
+	}
+
+	// built through reflect, as go vet rejects the two fields tagged "name" at the same depth
+	collision := reflect.StructOf([]reflect.StructField{
+		{Name: "EmbeddedBase", Type: reflect.TypeOf(EmbeddedBase{}), Anonymous: true},
+		{Name: "EmbeddedAudit", Type: reflect.TypeOf(EmbeddedAudit{}), Anonymous: true},
+		{Name: "ID", Type: reflect.TypeOf(0), Tag: `json:"id"`}, // shallower, so dominates EmbeddedBase.ID
+	})
+	collided := reflect.New(collision)
+	collided.Elem().Field(0).Set(reflect.ValueOf(EmbeddedBase{1, "a"}))
+	collided.Elem().Field(1).Set(reflect.ValueOf(EmbeddedAudit{"b", "c"}))
+	collided.Elem().Field(2).SetInt(2)
+
+	type pointers struct {
+		*EmbeddedBase
+		*EmbeddedPtr
+		Last int `json:"last,omitempty"`
+	}
+
+	type taggedEmbed struct {
+		EmbeddedBase `json:"base"`
+	}
+
+	tests := []struct {
+		name string
+		enc  *StructEncoder
+		v    interface{}
+	}{
+		{
+			"Flattened",
+			NewStructEncoder(embedded{}),
+			&embedded{EmbeddedBase{1, "a"}, EmbeddedBase{2, "b"}, "c"},
+		},
+		{
+			"Collisions",
+			NewStructEncoder(reflect.Zero(collision).Interface()),
+			collided.Interface(),
+		},
+		{
+			"Nil pointers",
+			NewStructEncoder(pointers{}),
+			&pointers{},
+		},
+		{
+			"Nested nil pointer",
+			NewStructEncoder(pointers{}),
+			&pointers{EmbeddedPtr: &EmbeddedPtr{Ptr: "a"}, Last: 1},
+		},
+		{
+			"Pointers",
+			NewStructEncoder(pointers{}),
+			&pointers{&EmbeddedBase{1, "a"}, &EmbeddedPtr{"b", &embeddedDeep{EmbeddedBase{2, "c"}, "d"}}, 3},
+		},
+		{
+			"Tagged embed",
+			NewStructEncoder(taggedEmbed{}),
+			&taggedEmbed{EmbeddedBase{1, "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			tt.enc.Marshal(tt.v, buf)
+
+			want, _ := json.Marshal(tt.v)
+			if string(want) != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_EscapeMaps(t *testing.T) {
+
+	type escapes struct {
+		Map     map[string]string   `json:"map,escape"`
+		PtrMap  map[string]*string  `json:"ptrMap,escape"`
+		HTML    map[string]string   `json:"html,htmlescape"`
+		Nested  map[string][]string `json:"nested,escape"`
+		NilMap  map[string]string   `json:"nilMap,escape"`
+		Numbers []int               `json:"numbers,escape"`
+		N       int                 `json:"n"`
+	}
+
+	s := "<\n>"
+	v := escapes{
+		Map:     map[string]string{"b": "<\n>", "a": "\"q\""},
+		PtrMap:  map[string]*string{"a": &s, "b": nil},
+		HTML:    map[string]string{"a": "<\n>"},
+		Nested:  map[string][]string{"a": {"\t"}},
+		Numbers: []int{1, 2},
+		N:       12,
+	}
+
+	want := `{"map":{"a":"\"q\"","b":"<\n>"},"ptrMap":{"a":"<\n>","b":null},"html":{"a":"\u003c\n\u003e"},` +
+		`"nested":{"a":["\t"]},"nilMap":null,"numbers":[1,2],"n":12}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(escapes{}).Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_EscapeControlAndInvalidUTF8(t *testing.T) {
+
+	type escapes struct {
+		Str   string            `json:"str,escape"`
+		Slice []string          `json:"slice,escape"`
+		Map   map[string]string `json:"map"`
+		Key   string            `json:"k\"ey\u0001"`
+	}
+
+	v := escapes{
+		Str:   "nul\x00 bell\a bs\b ff\f vt\v esc\x1b us\x1f \"q\" \\ \n\r\t",
+		Slice: []string{"bad \xff utf8", "cut \xe2\x82 short", "ok ✓"},
+		Map:   map[string]string{"k\x01\"": "v"},
+		Key:   "key",
+	}
+
+	want := `{"str":"nul\u0000 bell\u0007 bs\u0008 ff\u000c vt\u000b esc\u001b us\u001f \"q\" \\ \n\r\t",` +
+		`"slice":["bad \ufffd utf8","cut \ufffd\ufffd short","ok ✓"],"map":{"k\u0001\"":"v"},"k\"ey\u0001":"key"}`
+
+	enc := NewStructEncoder(escapes{})
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&v, buf)
+
+	if !json.Valid(buf.Bytes) {
+		t.Fatalf("not valid JSON: %s", buf.Bytes)
+	}
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// and make sure it decodes back to what we started with
+	var back escapes
+	if err := json.Unmarshal(buf.Bytes, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Str != v.Str || back.Slice[0] != "bad \ufffd utf8" || back.Map["k\x01\""] != "v" {
+		t.Errorf("round trip mismatch: %+v", back)
+	}
+}
+
+func Test_HTMLEscape(t *testing.T) {
+
+	type htmlEscape struct {
+		Field  string   `json:"field,htmlescape"`
+		Ptr    *string  `json:"ptr,htmlescape"`
+		Slice  []string `json:"slice,htmlescape"`
+		Escape string   `json:"escape,escape"`
+		Plain  string   `json:"plain"`
+	}
+
+	s := "</script><script>alert('&')</script>"
+	v := htmlEscape{
+		Field:  s,
+		Ptr:    &s,
+		Slice:  []string{"a<b", "line\u2028para\u2029"},
+		Escape: "<\n>",
+		Plain:  "<>",
+	}
+
+	esc := `\u003c/script\u003e\u003cscript\u003ealert('\u0026')\u003c/script\u003e`
+
+	t.Run("Tag option", func(t *testing.T) {
+		want := `{"field":"` + esc + `","ptr":"` + esc + `","slice":["a\u003cb","line\u2028para\u2029"],"escape":"<\n>","plain":"<>"}`
+
+		buf := NewBufferFromPool()
+		defer buf.ReturnToPool()
+		NewStructEncoder(htmlEscape{}).Marshal(&v, buf)
+
+		if want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+	})
+
+	t.Run("Encoder option", func(t *testing.T) {
+
+		type wrapper struct {
+			HTMLEscape htmlEscape        `json:"inner"`
+			Map        map[string]string `json:"map"`
+			Key        string            `json:"<key>"`
+		}
+
+		w := wrapper{v, map[string]string{"<k>": "<v>"}, "&"}
+
+		buf := NewBufferFromPool()
+		defer buf.ReturnToPool()
+		NewStructEncoder(wrapper{}, EscapeHTML()).Marshal(&w, buf)
+
+		// encoding/json escapes html by default
+		want, _ := json.Marshal(w)
+		if string(want) != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+	})
+
+	t.Run("SliceEncoder", func(t *testing.T) {
+		want := `["a\u003cb","line\u2028para\u2029"]`
+
+		for _, enc := range []*SliceEncoder{NewSliceEncoder([]HTMLEscapeString{}), NewSliceEncoder([]string{}, EscapeHTML())} {
+			buf := NewBufferFromPool()
+			enc.Marshal(&v.Slice, buf)
+
+			if want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+			}
+			buf.ReturnToPool()
+		}
+	})
+}
+
+func Test_StringOption(t *testing.T) {
+
+	type stringOption struct {
+		Bool    bool     `json:"bool,string"`
+		Int     int      `json:"int,string"`
+		Int8    int8     `json:"int8,string"`
+		Int16   int16    `json:"int16,string"`
+		Int32   int32    `json:"int32,string"`
+		Int64   int64    `json:"int64,string"`
+		Uint    uint     `json:"uint,string"`
+		Uint8   uint8    `json:"uint8,string"`
+		Uint16  uint16   `json:"uint16,string"`
+		Uint32  uint32   `json:"uint32,string"`
+		Uint64  uint64   `json:"uint64,string"`
+		Float32 float32  `json:"float32,string"`
+		Float64 float64  `json:"float64,string"`
+		Ptr     *int64   `json:"ptr,string"`
+		NilPtr  *uint64  `json:"nilPtr,string"`
+		Omit    int64    `json:"omit,omitempty,string"`
+		Slice   []string `json:"slice,string"`
+	}
+
+	id := int64(9007199254740993)
+	v := stringOption{
+		Bool:    true,
+		Int:     -1,
+		Int8:    -8,
+		Int16:   -16,
+		Int32:   -32,
+		Int64:   -64,
+		Uint:    1,
+		Uint8:   8,
+		Uint16:  16,
+		Uint32:  32,
+		Uint64:  18446744073709551615,
+		Float32: 1.5,
+		Float64: -2.25,
+		Ptr:     &id,
+		Slice:   []string{"a"},
+	}
+
+	want := `{"bool":"true","int":"-1","int8":"-8","int16":"-16","int32":"-32","int64":"-64","uint":"1","uint8":"8","uint16":"16","uint32":"32",` +
+		`"uint64":"18446744073709551615","float32":"1.5","float64":"-2.25","ptr":"9007199254740993","nilPtr":null,"slice":["a"]}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(stringOption{}).Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// make sure the stdlib can read it back
+	var back stringOption
+	if err := json.Unmarshal(buf.Bytes, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, back) {
+		t.Errorf("\nwant:\n%+v\ngot:\n%+v", v, back)
+	}
+}
+
+type valueMarshaler struct{ n int }
+
+func (m valueMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{"n":` + strconv.Itoa(m.n) + `}`), nil
+}
+
+type ptrMarshaler struct{ n int }
+
+func (m *ptrMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(m.n * 2)), nil
+}
+
+type textMarshalerImpl string
+
+func (m textMarshalerImpl) MarshalText() ([]byte, error) {
+	return []byte("<" + string(m) + ">"), nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{"unterminated"`), nil
+}
+
+type errMarshaler struct{}
+
+func (errMarshaler) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("nope")
+}
+
+func Test_Marshalers(t *testing.T) {
+
+	type marshalers struct {
+		Value   valueMarshaler        `json:"value"`
+		ValueP  *valueMarshaler       `json:"valueP"`
+		Ptr     ptrMarshaler          `json:"ptr"`
+		PtrP    *ptrMarshaler         `json:"ptrP"`
+		NilP    *ptrMarshaler         `json:"nilP"`
+		Text    textMarshalerImpl     `json:"text"`
+		TextP   *textMarshalerImpl    `json:"textP"`
+		Addr    netip.Addr            `json:"addr"`
+		Big     *big.Int              `json:"big"`
+		Values  []valueMarshaler      `json:"values"`
+		PtrsP   []*ptrMarshaler       `json:"ptrsP"`
+		Texts   []textMarshalerImpl   `json:"texts"`
+		TextMap map[string]netip.Addr `json:"textMap"`
+	}
+
+	text := textMarshalerImpl("b")
+	v := marshalers{
+		Value:   valueMarshaler{1},
+		ValueP:  &valueMarshaler{2},
+		Ptr:     ptrMarshaler{3},
+		PtrP:    &ptrMarshaler{4},
+		Text:    "a",
+		TextP:   &text,
+		Addr:    netip.MustParseAddr("10.0.0.1"),
+		Big:     new(big.Int).Lsh(big.NewInt(1), 70),
+		Values:  []valueMarshaler{{5}, {6}},
+		PtrsP:   []*ptrMarshaler{{7}, nil},
+		Texts:   []textMarshalerImpl{"c"},
+		TextMap: map[string]netip.Addr{"x": netip.MustParseAddr("::1")},
+	}
+
+	want, err := json.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(marshalers{}, EscapeHTML()).Marshal(&v, buf) // the stdlib escapes text output for html
+
+	if string(want) != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// and the same for slice encoders used on their own
+	buf.Reset()
+	NewSliceEncoder([]*textMarshalerImpl{}).Marshal(&[]*textMarshalerImpl{&text, nil}, buf)
+	if want := `["<b>",null]`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_MarshalerInvalid(t *testing.T) {
+
+	type invalid struct {
+		Bad badMarshaler `json:"bad"`
+		Err errMarshaler `json:"err"`
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"Verbatim", nil, `{"bad":{"unterminated","err":null}`},
+		{"Validated", []Option{ValidateJSON()}, `{"bad":null,"err":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+			NewStructEncoder(invalid{}, tt.opts...).Marshal(&invalid{}, buf)
+
+			if tt.want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+			}
+		})
+	}
+}
+
+// errTextKey is a map key which can't be written
+type errTextKey struct{}
+
+func (errTextKey) MarshalText() ([]byte, error) {
+	return nil, errEncode
+}
+
+func Test_MarshalerErrors(t *testing.T) {
+
+	type failing struct {
+		Name string       `json:"name"`
+		Err  errMarshaler `json:"err"`
+	}
+	type failingKey struct {
+		Keys map[errTextKey]int `json:"keys"`
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	// MarshalE, Marshal and MarshalTo return the error, as encoding/json does
+	var me *MarshalerError
+	err := NewStructEncoder(failing{}).MarshalE(&failing{Name: "a"}, buf)
+	if !errors.As(err, &me) || me.Path != "failing.Err" || me.Type != reflect.TypeOf(errMarshaler{}) {
+		t.Errorf("want *MarshalerError at failing.Err, got %v", err)
+	}
+	if _, err := Marshal(&failing{}); !errors.As(err, &me) {
+		t.Errorf("want *MarshalerError from Marshal, got %v", err)
+	}
+	if err := MarshalTo(io.Discard, &failing{}); !errors.As(err, &me) {
+		t.Errorf("want *MarshalerError from MarshalTo, got %v", err)
+	}
+
+	// as do map keys
+	buf.Reset()
+	err = NewStructEncoder(failingKey{}).MarshalE(&failingKey{map[errTextKey]int{{}: 1}}, buf)
+	if !errors.As(err, &me) || !errors.Is(err, errEncode) || me.Path != "failingKey.Keys" {
+		t.Errorf("want *MarshalerError at failingKey.Keys, got %v", err)
+	}
+
+	// Marshal has nobody to tell, so carries on
+	buf.Reset()
+	NewStructEncoder(failingKey{}).Marshal(&failingKey{map[errTextKey]int{{}: 1}}, buf)
+	if want := `{"keys":{"":1}}`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+type byteString []byte
+
+func Test_Bytes(t *testing.T) {
+
+	type bytesFields struct {
+		Bytes    []byte            `json:"bytes"`
+		Empty    []byte            `json:"empty"`
+		Nil      []byte            `json:"nil"`
+		Ptr      *[]byte           `json:"ptr"`
+		NilPtr   *[]byte           `json:"nilPtr"`
+		Named    byteString        `json:"named"`
+		Nested   [][]byte          `json:"nested"`
+		Map      map[string][]byte `json:"map"`
+		Iface    interface{}       `json:"iface"`
+		Omit     []byte            `json:"omit,omitempty"`
+		Raw      json.RawMessage   `json:"raw"`
+		Unsigned []uint8           `json:"unsigned"`
+	}
+
+	b := []byte("hello, world?>")
+	v := bytesFields{
+		Bytes:    b,
+		Empty:    []byte{},
+		Ptr:      &b,
+		Named:    byteString{0, 1, 2, 0xff},
+		Nested:   [][]byte{b, nil},
+		Map:      map[string][]byte{"k": {0xfb, 0xff}},
+		Iface:    []byte{1},
+		Raw:      json.RawMessage(`{"raw":true}`),
+		Unsigned: []uint8{7},
+	}
+
+	want, err := json.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(bytesFields{}).Marshal(&v, buf)
+
+	if string(want) != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// and on their own
+	buf.Reset()
+	NewSliceEncoder([]byte{}).Marshal(&b, buf)
+	if want := `"aGVsbG8sIHdvcmxkPz4="`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_BytesOptions(t *testing.T) {
+
+	type bytesOptions struct {
+		Hex        []byte  `json:"hex,hex"`
+		HexP       *[]byte `json:"hexP,hex"`
+		HexNil     []byte  `json:"hexNil,hex"`
+		Base64URL  []byte  `json:"base64url,base64url"`
+		Base64URLP *[]byte `json:"base64urlP,base64url"`
+		Ignored    string  `json:"ignored,hex"`
+	}
+
+	b := []byte{0xfb, 0xff, 0x00, 0x10}
+	v := bytesOptions{
+		Hex:        b,
+		HexP:       &b,
+		Base64URL:  b,
+		Base64URLP: &b,
+		Ignored:    "str",
+	}
+
+	want := `{"hex":"fbff0010","hexP":"fbff0010","hexNil":null,"base64url":"-_8AEA","base64urlP":"-_8AEA","ignored":"str"}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(bytesOptions{})
+	enc.Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Marshal(&v, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("want 0 allocs, got %v", allocs)
+	}
+}
+
+func TestArrayEncoder(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	ts := time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC)
+	s := "b"
+
+	tests := []struct {
+		name string
+		enc  *ArrayEncoder
+		v    interface{}
+		want string
+	}{
+		{
+			"ArrayEncoder Empty",
+			NewArrayEncoder([0]int{}),
+			&[0]int{},
+			`[]`,
+		},
+		{
+			"ArrayEncoder Int",
+			NewArrayEncoder([3]int{}),
+			&[3]int{1, 2, 3},
+			`[1,2,3]`,
+		},
+		{
+			"ArrayEncoder Bytes",
+			NewArrayEncoder([2]byte{}),
+			&[2]byte{1, 2},
+			`[1,2]`,
+		},
+		{
+			"ArrayEncoder String",
+			NewArrayEncoder([2]string{}),
+			&[2]string{"a", "b"},
+			`["a","b"]`,
+		},
+		{
+			"ArrayEncoder EscapeString",
+			NewArrayEncoder([1]EscapeString{}),
+			&[1]EscapeString{`"a"`},
+			`["\"a\""]`,
+		},
+		{
+			"ArrayEncoder Time",
+			NewArrayEncoder([1]time.Time{}),
+			&[1]time.Time{ts},
+			`["2000-09-17T20:04:26Z"]`,
+		},
+		{
+			"ArrayEncoder Struct",
+			NewArrayEncoder([2]inner{}),
+			&[2]inner{{"a"}, {"b"}},
+			`[{"name":"a"},{"name":"b"}]`,
+		},
+		{
+			"ArrayEncoder Pointers",
+			NewArrayEncoder([3]*string{}),
+			&[3]*string{&s, nil, &s},
+			`["b",null,"b"]`,
+		},
+		{
+			"ArrayEncoder Slices",
+			NewArrayEncoder([2][]int{}),
+			&[2][]int{{1, 2}, {3}},
+			`[[1,2],[3]]`,
+		},
+		{
+			"ArrayEncoder Nested",
+			NewArrayEncoder([2][2]float64{}),
+			&[2][2]float64{{1, 1.5}, {2, 2.5}},
+			`[[1,1.5],[2,2.5]]`,
+		},
+		{
+			"ArrayEncoder Maps",
+			NewArrayEncoder([1]map[string]int{}),
+			&[1]map[string]int{{"a": 1}},
+			`[{"a":1}]`,
+		},
+		{
+			"ArrayEncoder Interfaces",
+			NewArrayEncoder([3]interface{}{}),
+			&[3]interface{}{1, "a", nil},
+			`[1,"a",null]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			tt.enc.Marshal(tt.v, buf)
+
+			if tt.want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_ArrayFields(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	type arrays struct {
+		Ints    [3]int            `json:"ints"`
+		Strings [2]string         `json:"strings"`
+		Structs [2]inner          `json:"structs"`
+		Ptr     *[2]int           `json:"ptr"`
+		NilPtr  *[2]int           `json:"nilPtr"`
+		Times   [1]time.Time      `json:"times"`
+		Nested  [2][2]string      `json:"nested"`
+		Slice   [][2]int          `json:"slice"`
+		PtrS    []*[1]string      `json:"ptrS"`
+		Map     map[string][1]int `json:"map"`
+		Empty   [0]int            `json:"empty"`
+	}
+
+	v := arrays{
+		Ints:    [3]int{1, 2, 3},
+		Strings: [2]string{"a", "<b>"},
+		Structs: [2]inner{{"c"}, {"d"}},
+		Ptr:     &[2]int{4, 5},
+		Times:   [1]time.Time{time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC)},
+		Nested:  [2][2]string{{"e", "f"}, {"g", "h"}},
+		Slice:   [][2]int{{6, 7}},
+		PtrS:    []*[1]string{{"i"}, nil},
+		Map:     map[string][1]int{"j": {8}},
+	}
+
+	want, err := json.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	NewStructEncoder(arrays{}, EscapeHTML()).Marshal(&v, buf)
+
+	if string(want) != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func marshalWith[T any](t *testing.T, enc *Encoder[T], v *T, want string) {
+	t.Helper()
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc.Marshal(v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	t.Run("Struct", func(t *testing.T) {
+		marshalWith(t, NewEncoder[inner](), &inner{"a"}, `{"name":"a"}`)
+	})
+	t.Run("Struct Nil", func(t *testing.T) {
+		marshalWith(t, NewEncoder[inner](), nil, `null`)
+	})
+	t.Run("Slice", func(t *testing.T) {
+		marshalWith(t, NewEncoder[[]inner](), &[]inner{{"a"}, {"b"}}, `[{"name":"a"},{"name":"b"}]`)
+	})
+	t.Run("Bytes", func(t *testing.T) {
+		marshalWith(t, NewEncoder[[]byte](), &[]byte{1, 2, 3}, `"AQID"`)
+	})
+	t.Run("Array", func(t *testing.T) {
+		marshalWith(t, NewEncoder[[2]string](), &[2]string{"a", "b"}, `["a","b"]`)
+	})
+	t.Run("Map", func(t *testing.T) {
+		marshalWith(t, NewEncoder[map[string]int](), &map[string]int{"b": 2, "a": 1}, `{"a":1,"b":2}`)
+	})
+	t.Run("Int", func(t *testing.T) {
+		i := 42
+		marshalWith(t, NewEncoder[int](), &i, `42`)
+	})
+	t.Run("String", func(t *testing.T) {
+		s := "<a>"
+		marshalWith(t, NewEncoder[string](EscapeHTML()), &s, `"\u003ca\u003e"`)
+	})
+	t.Run("Pointer", func(t *testing.T) {
+		p := &inner{"a"}
+		marshalWith(t, NewEncoder[*inner](), &p, `{"name":"a"}`)
+		p = nil
+		marshalWith(t, NewEncoder[*inner](), &p, `null`)
+	})
+	t.Run("Interface", func(t *testing.T) {
+		var i interface{} = inner{"a"}
+		marshalWith(t, NewEncoder[interface{}](), &i, `{"name":"a"}`)
+	})
+	t.Run("Time", func(t *testing.T) {
+		ts := time.Date(2000, 9, 17, 20, 4, 26, 0, time.UTC)
+		marshalWith(t, NewEncoder[time.Time](), &ts, `"2000-09-17T20:04:26Z"`)
+	})
+}
+
+func BenchmarkEncoder(b *testing.B) {
+
+	e := NewEncoder[all]()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		e.Marshal(fake, buf)
+		buf.ReturnToPool()
+	}
+}
+
+func Test_Marshal(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	type outer struct {
+		Inner  inner            `json:"inner"`
+		Ptr    *inner           `json:"ptr"`
+		Slice  []inner          `json:"slice"`
+		Map    map[string]inner `json:"map"`
+		Number float64          `json:"number"`
+	}
+
+	o := outer{
+		Inner:  inner{"a"},
+		Ptr:    &inner{"b"},
+		Slice:  []inner{{"c"}},
+		Map:    map[string]inner{"d": {"e"}},
+		Number: 1.5,
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"Struct", o},
+		{"Struct Pointer", &o},
+		{"Nil Pointer", (*outer)(nil)},
+		{"Nil", nil},
+		{"Slice", []inner{{"a"}, {"b"}}},
+		{"Slice Pointer", &[]inner{{"a"}}},
+		{"Map", map[string]int{"b": 2, "a": 1}},
+		{"Array", [2]string{"a", "b"}},
+		{"Int", 42},
+		{"String", "str"},
+		{"Bytes", []byte("bytes")},
+		{"Single Pointer Struct", struct {
+			P *inner `json:"p"`
+		}{&inner{"a"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			want, err := json.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(want) != string(got) {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, got)
+			}
+
+			var w bytes.Buffer
+			if err := MarshalTo(&w, tt.v); err != nil {
+				t.Fatal(err)
+			}
+			if string(want) != w.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, w.Bytes())
+			}
+
+			got = Append([]byte("prefix:"), tt.v)
+			if "prefix:"+string(want) != string(got) {
+				t.Errorf("\nwant:\nprefix:%s\ngot:\n%s", want, got)
+			}
+		})
+	}
+}
+
+func Test_MarshalUnsupported(t *testing.T) {
+
+	type unsupported struct {
+		C chan int `json:"c"`
+	}
+
+	if _, err := Marshal(unsupported{}); err == nil {
+		t.Error("want error for unsupported type")
+	}
+
+	if err := MarshalTo(io.Discard, make(chan int)); err == nil {
+		t.Error("want error for unsupported type")
+	}
+
+	// types found in interfaces are only compiled once they're seen, but are returned all the same
+	type dynamic struct {
+		D interface{} `json:"d"`
+	}
+	v := &dynamic{D: make(chan int)}
+
+	var ute *UnsupportedTypeError
+	if _, err := Marshal(v); !errors.As(err, &ute) || ute.Type != reflect.TypeOf(v.D) {
+		t.Errorf("want *UnsupportedTypeError for %T, got %v", v.D, err)
+	}
+	if err := MarshalTo(io.Discard, []interface{}{1, v.D}); !errors.As(err, &ute) {
+		t.Errorf("want *UnsupportedTypeError, got %v", err)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	if err := NewStructEncoder(dynamic{}).MarshalE(v, buf); !errors.As(err, &ute) {
+		t.Errorf("want *UnsupportedTypeError, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("want Append to panic for unsupported type")
+		}
+	}()
+	Append(nil, unsupported{})
+}
+
+func Test_MarshalConcurrent(t *testing.T) {
+
+	type concurrent struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			defer func() { done <- true }()
+
+			v := concurrent{i, strconv.Itoa(i)}
+			want, _ := json.Marshal(&v)
+			for j := 0; j < 100; j++ {
+				got, err := Marshal(&v)
+				if err != nil || string(want) != string(got) {
+					t.Errorf("\nwant:\n%s\ngot:\n%s (%v)", want, got, err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+
+	dst := make([]byte, 0, 4096)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = Append(dst[:0], fake)
+	}
+}
+
+type orderItem struct {
+	Name  string     `json:"name"`
+	Price complex128 `json:"price"`
+}
+
+type order struct {
+	ID    int         `json:"id"`
+	Items []orderItem `json:"items"`
+}
+
+func Test_UnsupportedTypeError(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		new    func() error
+		path   string
+		typ    reflect.Type
+		reason string
+	}{
+		{
+			"Nested Field",
+			func() error { _, err := NewStructEncoderE(order{}); return err },
+			"order.Items[].Price",
+			reflect.TypeOf(complex128(0)),
+			"no JSON representation for kind complex128",
+		},
+		{
+			"Pointer Field",
+			func() error {
+				_, err := NewStructEncoderE(struct {
+					F *func() `json:"f"`
+				}{})
+				return err
+			},
+			"F",
+			reflect.TypeOf((*func())(nil)),
+			"no JSON representation for kind func",
+		},
+		{
+			"Map Value",
+			func() error {
+				_, err := NewStructEncoderE(struct {
+					M map[string]chan int `json:"m"`
+				}{})
+				return err
+			},
+			"M{}",
+			reflect.TypeOf(make(chan int)),
+			"no JSON representation for kind chan",
+		},
+		{
+			"Map Key",
+			func() error {
+				_, err := NewStructEncoderE(struct {
+					M map[[2]int]string `json:"m"`
+				}{})
+				return err
+			},
+			"M",
+			reflect.TypeOf([2]int{}),
+			"map keys must be strings, integers or implement encoding.TextMarshaler",
+		},
+		{
+			"Slice",
+			func() error { _, err := NewSliceEncoderE([]uintptr{}); return err },
+			"[]",
+			reflect.TypeOf(uintptr(0)),
+			"no JSON representation for kind uintptr",
+		},
+		{
+			"Slice Of Structs",
+			func() error { _, err := NewSliceEncoderE([]*order{}); return err },
+			"[].Items[].Price",
+			reflect.TypeOf(complex128(0)),
+			"no JSON representation for kind complex128",
+		},
+		{
+			"Marshal",
+			func() error { _, err := Marshal(&order{}); return err },
+			"order.Items[].Price",
+			reflect.TypeOf(complex128(0)),
+			"no JSON representation for kind complex128",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.new()
+
+			var ute *UnsupportedTypeError
+			if !errors.As(err, &ute) {
+				t.Fatalf("want *UnsupportedTypeError, got %v", err)
+			}
+
+			if ute.Path != tt.path || ute.Type != tt.typ || ute.Reason != tt.reason {
+				t.Errorf("\nwant:\n%s %v %s\ngot:\n%s %v %s", tt.path, tt.typ, tt.reason, ute.Path, ute.Type, ute.Reason)
+			}
+		})
+	}
+
+	// the constructors which don't return errors panic with them instead
+	defer func() {
+		if _, ok := recover().(*UnsupportedTypeError); !ok {
+			t.Error("want NewStructEncoder to panic with *UnsupportedTypeError")
+		}
+	}()
+	NewStructEncoder(order{})
+}
+
+func Test_SkipUnsupported(t *testing.T) {
+
+	type skipped struct {
+		Func    func()      `json:"func,skipunsupported"`
+		ID      int         `json:"id"`
+		Chan    chan int    `json:"chan,omitempty,skipunsupported"`
+		Items   []orderItem `json:"items,skipunsupported"`
+		Name    string      `json:"name,omitempty"`
+		Complex *complex64  `json:"complex,skipunsupported"`
+		Ok      []string    `json:"ok,skipunsupported"`
+	}
+
+	v := skipped{
+		ID:   1,
+		Name: "a",
+		Ok:   []string{"b"},
+	}
+
+	want := `{"id":1,"name":"a","ok":["b"]}`
+
+	enc, err := NewStructEncoderE(skipped{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// and when the only field always written is skipped, separators are still decided correctly
+	type leading struct {
+		Func func() `json:"func,skipunsupported"`
+		A    string `json:"a,omitempty"`
+		B    string `json:"b,omitempty"`
+	}
+
+	buf.Reset()
+	NewStructEncoder(leading{}).Marshal(&leading{B: "b"}, buf)
+	if want := `{"b":"b"}`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+var errEncode = errors.New("encode failed")
+
+type encoderE struct{ fail bool }
+
+func (e *encoderE) JSONEncodeE(w *Buffer) error {
+	if e.fail {
+		return errEncode
+	}
+	w.WriteString(`"encoderE"`)
+	return nil
+}
+
+type marshalerE struct{ fail bool }
+
+func (m marshalerE) EncodeJSONE(w io.Writer) error {
+	if m.fail {
+		w.Write([]byte(`"partial`))
+		return errEncode
+	}
+	_, err := w.Write([]byte(`"marshalerE"`))
+	return err
+}
+
+func Test_MarshalE(t *testing.T) {
+
+	type item struct {
+		Name string      `json:"name"`
+		Enc  encoderE    `json:"enc,encoder"`
+		Mar  *marshalerE `json:"mar,encoder"`
+	}
+
+	type doc struct {
+		ID    int    `json:"id"`
+		Items []item `json:"items"`
+	}
+
+	enc := NewStructEncoder(doc{})
+
+	t.Run("Success", func(t *testing.T) {
+		v := doc{1, []item{{"a", encoderE{}, &marshalerE{}}, {"b", encoderE{}, nil}}}
+		want := `{"id":1,"items":[{"name":"a","enc":"encoderE","mar":"marshalerE"},{"name":"b","enc":"encoderE","mar":null}]}`
+
+		buf := NewBufferFromPool()
+		defer buf.ReturnToPool()
+
+		if err := enc.MarshalE(&v, buf); err != nil {
+			t.Fatal(err)
+		}
+		if want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+
+		// the same as Marshal
+		buf.Reset()
+		enc.Marshal(&v, buf)
+		if want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+	})
+
+	tests := []struct {
+		name string
+		v    doc
+		path string
+		typ  reflect.Type
+		want string // what's left in the buffer
+	}{
+		{
+			"JSONEncoderE",
+			doc{1, []item{{"a", encoderE{}, nil}, {"b", encoderE{fail: true}, nil}}},
+			"doc.Items[].Enc",
+			reflect.TypeOf(encoderE{}),
+			`{"id":1,"items":[{"name":"a","enc":"encoderE","mar":null},{"name":"b","enc":`,
+		},
+		{
+			"JSONMarshalerE",
+			doc{1, []item{{"a", encoderE{}, &marshalerE{fail: true}}}},
+			"doc.Items[].Mar",
+			reflect.TypeOf(marshalerE{}),
+			`{"id":1,"items":[{"name":"a","enc":"encoderE","mar":"partial`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+
+			err := enc.MarshalE(&tt.v, buf)
+
+			var me *MarshalerError
+			if !errors.As(err, &me) {
+				t.Fatalf("want *MarshalerError, got %v", err)
+			}
+			if me.Path != tt.path || me.Type != tt.typ || !errors.Is(err, errEncode) {
+				t.Errorf("\nwant:\n%s %v %v\ngot:\n%s %v %v", tt.path, tt.typ, errEncode, me.Path, me.Type, me.Err)
+			}
+			if tt.want != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+			}
+
+			// the slice encoder and Marshal stop in the same way
+			buf.Reset()
+			if err := NewSliceEncoder([]item{}).MarshalE(&tt.v.Items, buf); !errors.Is(err, errEncode) {
+				t.Errorf("want %v from SliceEncoder, got %v", errEncode, err)
+			}
+			if _, err := Marshal(&tt.v); !errors.Is(err, errEncode) {
+				t.Errorf("want %v from Marshal, got %v", errEncode, err)
+			}
+
+			// whereas Marshal carries on to the end regardless
+			buf.Reset()
+			enc.Marshal(&tt.v, buf)
+			if !bytes.HasSuffix(buf.Bytes, []byte("}]}")) {
+				t.Errorf("want Marshal to ignore the error, got %s", buf.Bytes)
+			}
+		})
+	}
+}
+
+func Test_MarshalIndent(t *testing.T) {
+
+	type inner struct {
+		Name string `json:"name"`
+	}
+
+	type indented struct {
+		ID      int              `json:"id"`
+		Tricky  string           `json:"tricky,escape"`
+		Inner   inner            `json:"inner"`
+		Ptr     *inner           `json:"ptr"`
+		Nil     *inner           `json:"nil"`
+		Slice   []inner          `json:"slice"`
+		Empty   []int            `json:"empty"`
+		Nested  [][]int          `json:"nested"`
+		Map     map[string][]int `json:"map"`
+		EmptyM  map[string]int   `json:"emptyM"`
+		Iface   interface{}      `json:"iface"`
+		Raw     json.RawMessage  `json:"raw"`
+		Numbers [2]float64       `json:"numbers"`
+	}
+
+	v := indented{
+		ID:      1,
+		Tricky:  `{"a": [1, 2]}, \"quoted\" \\`,
+		Inner:   inner{"a"},
+		Ptr:     &inner{"b"},
+		Slice:   []inner{{"c"}, {"d"}},
+		Empty:   []int{},
+		Nested:  [][]int{{1, 2}, {}},
+		Map:     map[string][]int{"x": {3}},
+		EmptyM:  map[string]int{},
+		Iface:   map[string]interface{}{"y": []interface{}{true, nil}},
+		Raw:     json.RawMessage(`{ "spaced" : [ 1 ,2 ] }`),
+		Numbers: [2]float64{1.5, 2},
+	}
+
+	tests := []struct {
+		name           string
+		prefix, indent string
+	}{
+		{"Indent", "", "  "},
+		{"Tabs", "", "\t"},
+		{"Prefix", "//", "    "},
+		{"Prefix Only", "> ", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			want, err := json.MarshalIndent(&v, tt.prefix, tt.indent)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := NewBufferFromPool()
+			defer buf.ReturnToPool()
+			NewStructEncoder(indented{}).MarshalIndent(&v, buf, tt.prefix, tt.indent)
+
+			if string(want) != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+			}
+
+			want, err = json.MarshalIndent(v.Slice, tt.prefix, tt.indent)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf.Reset()
+			NewSliceEncoder([]inner{}).MarshalIndent(&v.Slice, buf, tt.prefix, tt.indent)
+
+			if string(want) != buf.String() {
+				t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalIndent(b *testing.B) {
+
+	e := NewStructEncoder(fakeType)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := NewBufferFromPool()
+		e.MarshalIndent(fake, buf, "", "  ")
+		buf.ReturnToPool()
+	}
+}
+
+func BenchmarkMarshalIndentStdLib(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		by, _ := json.MarshalIndent(fake, "", "  ")
+		_ = by
+	}
+}
+
+func Test_TimeFormats(t *testing.T) {
+
+	type nested struct {
+		Time time.Time `json:"time"`
+	}
+
+	type times struct {
+		Default   time.Time            `json:"default"`
+		Unix      time.Time            `json:"unix,time=unix"`
+		UnixMilli time.Time            `json:"unixmilli,time=unixmilli"`
+		UnixNano  time.Time            `json:"unixnano,time=unixnano"`
+		RFC1123   time.Time            `json:"rfc1123,time=rfc1123"`
+		RFC3339   time.Time            `json:"rfc3339,time=rfc3339,utc"`
+		Date      time.Time            `json:"date,layout=2006-01-02"`
+		UTC       time.Time            `json:"utc,utc"`
+		DateUTC   time.Time            `json:"dateUTC,layout=2006-01-02T15:04,utc"`
+		Spaced    time.Time            `json:"spaced,layout=Mon_Jan__2_2006_15:04"`
+		Ptr       *time.Time           `json:"ptr,time=unix"`
+		NilPtr    *time.Time           `json:"nilPtr,time=unix"`
+		Slice     []time.Time          `json:"slice,time=unixmilli"`
+		PtrSlice  []*time.Time         `json:"ptrSlice,layout=2006-01-02"`
+		Array     [2]time.Time         `json:"array,time=unix"`
+		Map       map[string]time.Time `json:"map,time=unix"`
+		Nested    nested               `json:"nested,time=unix"`
+		Omit      time.Time            `json:"omit,omitempty,time=unix"`
+	}
+
+	loc := time.FixedZone("X", 2*60*60)
+	ts := time.Date(2020, 1, 2, 23, 4, 5, 6000000, loc)
+
+	v := times{
+		Default:   ts,
+		Unix:      ts,
+		UnixMilli: ts,
+		UnixNano:  ts,
+		RFC1123:   ts,
+		RFC3339:   ts,
+		Date:      ts,
+		UTC:       ts,
+		DateUTC:   ts,
+		Spaced:    ts,
+		Ptr:       &ts,
+		Slice:     []time.Time{ts, ts.Add(time.Second)},
+		PtrSlice:  []*time.Time{&ts, nil},
+		Array:     [2]time.Time{ts, ts},
+		Map:       map[string]time.Time{"a": ts},
+		Nested:    nested{ts},
+	}
+
+	want := `{"default":"2020-01-02T23:04:05.006+02:00",` +
+		`"unix":1577999045,` +
+		`"unixmilli":1577999045006,` +
+		`"unixnano":1577999045006000000,` +
+		`"rfc1123":"Thu, 02 Jan 2020 23:04:05 X",` +
+		`"rfc3339":"2020-01-02T21:04:05Z",` +
+		`"date":"2020-01-02",` +
+		`"utc":"2020-01-02T21:04:05.006Z",` +
+		`"dateUTC":"2020-01-02T21:04",` +
+		`"spaced":"Thu Jan  2 2020 23:04",` +
+		`"ptr":1577999045,` +
+		`"nilPtr":null,` +
+		`"slice":[1577999045006,1577999046006],` +
+		`"ptrSlice":["2020-01-02",null],` +
+		`"array":[1577999045,1577999045],` +
+		`"map":{"a":1577999045},` +
+		`"nested":{"time":"2020-01-02T23:04:05.006+02:00"}}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(times{})
+	enc.Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// maps are counted by Test_TimeFormatMapAllocs, as the race detector can't be trusted with them
+	v.Map = nil
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Marshal(&v, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("want 0 allocs, got %v", allocs)
+	}
+
+	// unknown formats are reported when compiling
+	_, err := NewStructEncoderE(struct {
+		T time.Time `json:"t,time=fortnights"`
+	}{})
+	var ute *UnsupportedTypeError
+	if !errors.As(err, &ute) || ute.Path != "T" {
+		t.Errorf("want *UnsupportedTypeError for T, got %v", err)
+	}
+}
+
+// raceEnabled is set by race_test.go when testing with -race
+var raceEnabled bool
+
+func Test_TimeFormatMapAllocs(t *testing.T) {
+
+	// maps borrow pooled state, and the race detector drops what's put back in a sync.Pool at random
+	if raceEnabled {
+		t.Skip("pooled map state can't be relied on under the race detector")
+	}
+
+	type times struct {
+		Map map[string]time.Time `json:"map,time=unix"`
+	}
+
+	enc := NewStructEncoder(times{})
+	v := times{Map: map[string]time.Time{"a": time.Unix(1577999045, 0), "b": time.Unix(1577999046, 0)}}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&v, buf)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Marshal(&v, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("want 0 allocs, got %v", allocs)
+	}
+}
+
+func Test_DurationFormats(t *testing.T) {
+
+	type durations struct {
+		Default  time.Duration            `json:"default"`
+		Nanos    time.Duration            `json:"nanos,duration=nanos"`
+		String   time.Duration            `json:"string,duration=string"`
+		Seconds  time.Duration            `json:"seconds,duration=seconds"`
+		Millis   time.Duration            `json:"millis,duration=millis"`
+		ISO8601  time.Duration            `json:"iso8601,duration=iso8601"`
+		Ptr      *time.Duration           `json:"ptr,duration=string"`
+		NilPtr   *time.Duration           `json:"nilPtr,duration=string"`
+		Slice    []time.Duration          `json:"slice,duration=seconds"`
+		PtrSlice []*time.Duration         `json:"ptrSlice,duration=iso8601"`
+		Array    [1]time.Duration         `json:"array,duration=millis"`
+		Map      map[string]time.Duration `json:"map,duration=string"`
+	}
+
+	d := time.Hour + 2*time.Minute + 3500*time.Millisecond
+	v := durations{
+		Default:  d,
+		Nanos:    d,
+		String:   d,
+		Seconds:  d,
+		Millis:   d,
+		ISO8601:  d,
+		Ptr:      &d,
+		Slice:    []time.Duration{d, -time.Millisecond},
+		PtrSlice: []*time.Duration{&d, nil},
+		Array:    [1]time.Duration{d},
+		Map:      map[string]time.Duration{"a": d},
+	}
+
+	want := `{"default":3723500000000,"nanos":3723500000000,"string":"1h2m3.5s","seconds":3723.5,"millis":3723500,` +
+		`"iso8601":"PT1H2M3.5S","ptr":"1h2m3.5s","nilPtr":null,"slice":[3723.5,-0.001],"ptrSlice":["PT1H2M3.5S",null],` +
+		`"array":[3723500],"map":{"a":"1h2m3.5s"}}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(durations{})
+	enc.Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// maps are counted by Test_DurationFormatMapAllocs, as the race detector can't be trusted with them
+	v.Map = nil
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Marshal(&v, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("want 0 allocs, got %v", allocs)
+	}
+}
+
+func Test_DurationFormatMapAllocs(t *testing.T) {
+
+	// maps borrow pooled state, and the race detector drops what's put back in a sync.Pool at random
+	if raceEnabled {
+		t.Skip("pooled map state can't be relied on under the race detector")
+	}
+
+	type durations struct {
+		Map map[string]time.Duration `json:"map,duration=string"`
+	}
+
+	enc := NewStructEncoder(durations{})
+	v := durations{Map: map[string]time.Duration{"a": 90 * time.Minute, "b": 1500 * time.Millisecond}}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+	enc.Marshal(&v, buf)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		enc.Marshal(&v, buf)
+	})
+	if allocs != 0 {
+		t.Errorf("want 0 allocs, got %v", allocs)
+	}
+}
+
+func Test_DurationString(t *testing.T) {
+
+	tests := []time.Duration{
+		0,
+		1,
+		999,
+		time.Microsecond,
+		1500 * time.Microsecond,
+		time.Millisecond + time.Nanosecond,
+		time.Second,
+		-time.Second,
+		90 * time.Minute,
+		100*time.Hour + time.Nanosecond,
+		math.MaxInt64,
+		math.MinInt64,
+	}
+
+	for _, d := range tests {
+		if want, got := d.String(), string(appendDurationString(nil, d)); want != got {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func Test_DurationISO8601(t *testing.T) {
+
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "PT0S"},
+		{time.Nanosecond, "PT0.000000001S"},
+		{time.Second, "PT1S"},
+		{time.Minute, "PT1M"},
+		{time.Hour, "PT1H"},
+		{time.Hour + 3*time.Second, "PT1H3S"},
+		{26*time.Hour + 30*time.Minute, "PT26H30M"},
+		{-(2*time.Minute + 250*time.Millisecond), "-PT2M0.25S"},
+	}
+
+	for _, tt := range tests {
+		if got := string(appendDurationISO8601(nil, tt.d)); tt.want != got {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, got)
+		}
+	}
+}
+
+// registeredID stands in for a third-party type, like a uuid, given a conversion through RegisterEncoder
+type registeredID [4]byte
+
+// registeredName is given a conversion through RegisterTypeEncoder
+type registeredName struct {
+	First, Last string
+}
+
+func init() {
+	RegisterEncoder(func(v *registeredID, w *Buffer) {
+		w.WriteByte('"')
+		hexToBuf(v[:], w)
+		w.WriteByte('"')
+	})
+	RegisterTypeEncoder(reflect.TypeOf(registeredName{}), func(v unsafe.Pointer, w *Buffer) {
+		n := (*registeredName)(v)
+		w.WriteByte('"')
+		w.WriteString(n.First)
+		w.WriteByte(' ')
+		w.WriteString(n.Last)
+		w.WriteByte('"')
+	})
+}
+
+func Test_RegisterEncoder(t *testing.T) {
+
+	type registered struct {
+		ID       registeredID               `json:"id"`
+		Ptr      *registeredID              `json:"ptr"`
+		NilPtr   *registeredID              `json:"nilPtr"`
+		Slice    []registeredID             `json:"slice"`
+		PtrSlice []*registeredID            `json:"ptrSlice"`
+		Array    [1]registeredID            `json:"array"`
+		Map      map[string]registeredID    `json:"map"`
+		Iface    interface{}                `json:"iface"`
+		Name     registeredName             `json:"name"`
+		Names    map[string]*registeredName `json:"names"`
+	}
+
+	id := registeredID{0xde, 0xad, 0xbe, 0xef}
+	name := registeredName{"Jane", "Doe"}
+	v := registered{
+		ID:       id,
+		Ptr:      &id,
+		Slice:    []registeredID{id},
+		PtrSlice: []*registeredID{&id, nil},
+		Array:    [1]registeredID{id},
+		Map:      map[string]registeredID{"a": id},
+		Iface:    id,
+		Name:     name,
+		Names:    map[string]*registeredName{"a": &name, "b": nil},
+	}
+
+	want := `{"id":"deadbeef","ptr":"deadbeef","nilPtr":null,"slice":["deadbeef"],"ptrSlice":["deadbeef",null],` +
+		`"array":["deadbeef"],"map":{"a":"deadbeef"},"iface":"deadbeef","name":"Jane Doe","names":{"a":"Jane Doe","b":null}}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(registered{})
+	enc.Marshal(&v, buf)
+
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+
+	// and on their own
+	buf.Reset()
+	NewSliceEncoder([]registeredName{}).Marshal(&[]registeredName{name}, buf)
+	NewEncoder[registeredID]().Marshal(&id, buf)
+	if want := `["Jane Doe"]"deadbeef"`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+type stdlibInner struct {
+	Inner   string
+	private string
+}
+
+type stdlibPromoted struct {
+	Promoted int
+}
+
+func Test_StdlibFields(t *testing.T) {
+
+	type stdlibFields struct {
+		Untagged  string
+		Tagged    string `json:"tagged"`
+		EmptyName int    `json:",omitempty"`
+		Omitted   int    `json:",omitempty"`
+		Skipped   string `json:"-"`
+		Dash      string `json:"-,"`
+		private   string
+		Nested    stdlibInner
+		Ptr       *stdlibInner
+		Slice     []stdlibInner
+		Map       map[string]stdlibInner
+		Iface     interface{}
+		Time      time.Time
+		stdlibPromoted
+	}
+
+	v := stdlibFields{
+		Untagged:       "a",
+		Tagged:         "b",
+		EmptyName:      1,
+		Skipped:        "c",
+		Dash:           "d",
+		private:        "e",
+		Nested:         stdlibInner{"f", "g"},
+		Slice:          []stdlibInner{{"h", "i"}},
+		Map:            map[string]stdlibInner{"j": {"k", "l"}},
+		Iface:          stdlibInner{"m", "n"},
+		Time:           time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		stdlibPromoted: stdlibPromoted{2},
+	}
+
+	want, _ := json.Marshal(v)
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(stdlibFields{}, StdlibFields())
+	enc.Marshal(&v, buf)
+
+	if string(want) != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+func Test_NamingStrategy(t *testing.T) {
+
+	tests := []struct {
+		name                            string
+		snake, camel, kebab, pascalCase string
+	}{
+		{"HTTPServerID", "http_server_id", "httpServerId", "http-server-id", "HttpServerId"},
+		{"UserName", "user_name", "userName", "user-name", "UserName"},
+		{"ID", "id", "id", "id", "Id"},
+		{"URL", "url", "url", "url", "Url"},
+		{"Base64Data", "base64_data", "base64Data", "base64-data", "Base64Data"},
+		{"V2API", "v2_api", "v2Api", "v2-api", "V2Api"},
+		{"Snake_Case", "snake_case", "snakeCase", "snake-case", "SnakeCase"},
+		{"A", "a", "a", "a", "A"},
+	}
+
+	for _, tt := range tests {
+		for s, want := range map[NamingStrategy]string{
+			GoName:     tt.name,
+			SnakeCase:  tt.snake,
+			CamelCase:  tt.camel,
+			KebabCase:  tt.kebab,
+			PascalCase: tt.pascalCase,
+		} {
+			if got := s.name(tt.name); want != got {
+				t.Errorf("%d %s: want %s got %s", s, tt.name, want, got)
+			}
+		}
+	}
+
+	type named struct {
+		HTTPServerID int
+		UserName     string `json:",omitempty"`
+		Tagged       string `json:"TaggedName"`
+		stdlibPromoted
+	}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	enc := NewStructEncoder(named{}, StdlibFields(), Naming(SnakeCase))
+	enc.Marshal(&named{1, "a", "b", stdlibPromoted{2}}, buf)
+
+	if want := `{"http_server_id":1,"user_name":"a","TaggedName":"b","promoted":2}`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+type treeNode struct {
+	Name     string              `json:"name"`
+	Children []treeNode          `json:"children"`
+	Index    map[string]treeNode `json:"index,omitempty"`
+	Parent   *treeNode           `json:"parent,omitempty"`
+}
+
+type cycleA struct {
+	Name string    `json:"name"`
+	B    *cycleB   `json:"b"`
+	Bs   [1]cycleB `json:"bs"`
+}
+
+type cycleB struct {
+	A   *cycleA            `json:"a"`
+	As  map[string]*cycleA `json:"as"`
+	Bad chan int           `json:"bad,skipunsupported"`
+}
+
+type nestedList []nestedList
+
+type nestedMap map[string]nestedMap
+
+// rollbackA refers to rollbackB twice; compiling rollbackB fails the first time round, and the second
+// must not find it half compiled
+type rollbackA struct {
+	First  *rollbackB `json:"first,skipunsupported"`
+	Second *rollbackB `json:"second"`
+}
+
+type rollbackB struct {
+	A   *rollbackA `json:"a"`
+	Bad chan int   `json:"bad"`
+}
+
+func Test_Recursion(t *testing.T) {
+
+	tree := treeNode{
+		Name: "root",
+		Children: []treeNode{
+			{Name: "a", Children: []treeNode{{Name: "aa"}}},
+			{Name: "b", Index: map[string]treeNode{"c": {Name: "c"}}},
+		},
+	}
+	tree.Children[0].Parent = &treeNode{Name: "up"}
+
+	a := cycleA{Name: "a1", B: &cycleB{A: &cycleA{Name: "a2"}, As: map[string]*cycleA{"x": {Name: "a3"}}}}
+
+	tests := []struct {
+		name string
+		enc  func(*Buffer)
+		want string
+	}{
+		{"tree", func(w *Buffer) { NewStructEncoder(treeNode{}).Marshal(&tree, w) },
+			`{"name":"root","children":[{"name":"a","children":[{"name":"aa","children":[]}],"parent":{"name":"up","children":[]}},` +
+				`{"name":"b","children":[],"index":{"c":{"name":"c","children":[]}}}]}`},
+		{"slice of trees", func(w *Buffer) { NewSliceEncoder([]treeNode{}).Marshal(&tree.Children, w) },
+			`[{"name":"a","children":[{"name":"aa","children":[]}],"parent":{"name":"up","children":[]}},` +
+				`{"name":"b","children":[],"index":{"c":{"name":"c","children":[]}}}]`},
+		{"mutual", func(w *Buffer) { NewStructEncoder(cycleA{}).Marshal(&a, w) },
+			`{"name":"a1","b":{"a":{"name":"a2","b":null,"bs":[{"a":null,"as":null}]},"as":{"x":{"name":"a3","b":null,"bs":[{"a":null,"as":null}]}}},` +
+				`"bs":[{"a":null,"as":null}]}`},
+		{"list", func(w *Buffer) { NewEncoder[nestedList]().Marshal(&nestedList{{}, {{}}}, w) }, `[[],[[]]]`},
+		{"map", func(w *Buffer) { NewEncoder[nestedMap]().Marshal(&nestedMap{"a": {"b": nil}}, w) }, `{"a":{"b":null}}`},
+	}
+
+	for _, tt := range tests {
+		buf := NewBufferFromPool()
+		tt.enc(buf)
+		if tt.want != buf.String() {
+			t.Errorf("%s\nwant:\n%s\ngot:\n%s", tt.name, tt.want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+
+	if _, err := NewStructEncoderE(rollbackA{}); err == nil {
+		t.Error("want an error for the second rollbackB, got none")
+	}
+}
+
+type pathLeaf struct {
+	F encoderE `json:"f,encoder"`
+}
+
+type pathRoot struct {
+	M map[string]pathLeaf `json:"m"`
+	L []pathLeaf          `json:"l"`
+	P pathLeaf            `json:"p"`
+}
+
+func Test_RecursionPaths(t *testing.T) {
+
+	// the same type at different paths is compiled for each, so errors give the path they happened at
+	enc := NewStructEncoder(pathRoot{})
+	fail := pathLeaf{encoderE{fail: true}}
+
+	tests := []struct {
+		v    pathRoot
+		path string
+	}{
+		{pathRoot{M: map[string]pathLeaf{"a": fail}}, "pathRoot.M{}.F"},
+		{pathRoot{L: []pathLeaf{fail}}, "pathRoot.L[].F"},
+		{pathRoot{P: fail}, "pathRoot.P.F"},
+	}
+
+	for _, tt := range tests {
+		buf := NewBufferFromPool()
+		var me *MarshalerError
+		if err := enc.MarshalE(&tt.v, buf); !errors.As(err, &me) || me.Path != tt.path {
+			t.Errorf("want an error at %s, got %v", tt.path, err)
+		}
+		buf.ReturnToPool()
+	}
+}
+
+type listNode struct {
+	Value int         `json:"value"`
+	Next  *listNode   `json:"next"`
+	Prev  *listNode   `json:"prev"`
+	Links []*listNode `json:"links,omitempty"`
+}
+
+func Test_Guards(t *testing.T) {
+
+	// a -> b -> c, with back-pointers
+	a, b, c := &listNode{Value: 1}, &listNode{Value: 2}, &listNode{Value: 3}
+	a.Next, b.Next = b, c
+	b.Prev, c.Prev = a, b
+
+	// d links to e twice, which is shared but not a cycle
+	e := &listNode{Value: 5}
+	d := &listNode{Value: 4, Links: []*listNode{e, e, nil}}
+
+	tests := []struct {
+		name string
+		opts []Option
+		v    *listNode
+		want string
+		err  error
+		path string
+	}{
+		{"cycles", []Option{DetectCycles()}, a,
+			`{"value":1,"next":{"value":2,"next":{"value":3,"next":null,"prev":null},"prev":{"value":1,"next":null,"prev":null}},"prev":null}`,
+			ErrCycle, "listNode.Prev"},
+		{"depth", []Option{MaxDepth(2)}, a,
+			`{"value":1,"next":{"value":2,"next":{"value":3,"next":null,"prev":null},"prev":{"value":1,"next":null,"prev":null}},"prev":null}`,
+			ErrMaxDepth, "listNode.Prev"},
+		{"shared", []Option{DetectCycles(), MaxDepth(2)}, d,
+			`{"value":4,"next":null,"prev":null,"links":[{"value":5,"next":null,"prev":null},{"value":5,"next":null,"prev":null},null]}`,
+			nil, ""},
+		{"links", []Option{DetectCycles()}, &listNode{Value: 6, Links: []*listNode{a}},
+			`{"value":6,"next":null,"prev":null,"links":[{"value":1,"next":{"value":2,"next":{"value":3,"next":null,"prev":null},"prev":null},"prev":null}]}`,
+			ErrCycle, "listNode.Prev"},
+	}
+
+	for _, tt := range tests {
+		enc := NewStructEncoder(listNode{}, tt.opts...)
+
+		buf := NewBufferFromPool()
+		enc.Marshal(tt.v, buf)
+		if tt.want != buf.String() {
+			t.Errorf("%s\nwant:\n%s\ngot:\n%s", tt.name, tt.want, buf.Bytes)
+		}
+
+		buf.Reset()
+		err := enc.MarshalE(tt.v, buf)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.err, err)
+		}
+		var me *MarshalerError
+		if errors.As(err, &me) && me.Path != tt.path {
+			t.Errorf("%s: want path %s, got %s", tt.name, tt.path, me.Path)
+		}
+		if buf.depth != 0 || len(buf.visiting) != 0 {
+			t.Errorf("%s: buffer left at depth %d with %d visiting", tt.name, buf.depth, len(buf.visiting))
+		}
+		buf.ReturnToPool()
+	}
+
+	// slices of pointers are checked as well
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	if err := NewSliceEncoder([]*listNode{}, DetectCycles()).MarshalE(&[]*listNode{b}, buf); !errors.Is(err, ErrCycle) {
+		t.Errorf("want %v, got %v", ErrCycle, err)
+	}
+}
+
+func Test_PointerShapes(t *testing.T) {
+
+	type inner struct {
+		A int `json:"a"`
+	}
+
+	type shapes struct {
+		Slice       *[]int               `json:"slice"`
+		StructSlice *[]inner             `json:"structSlice"`
+		Bytes       *[]byte              `json:"bytes"`
+		Array       *[2]string           `json:"array"`
+		Map         *map[string]int      `json:"map"`
+		PtrInt      **int                `json:"ptrInt"`
+		PtrString   **string             `json:"ptrString"`
+		PtrStruct   **inner              `json:"ptrStruct"`
+		PtrSlice    **[]int              `json:"ptrSlice"`
+		PtrPtrMap   ***map[string]string `json:"ptrPtrMap"`
+		Elems       []**int              `json:"elems"`
+		PtrSlices   []*[]int             `json:"ptrSlices"`
+		Escaped     *[]string            `json:"escaped,escape"`
+	}
+
+	i, s, in := 1, "s", inner{2}
+	pi, ps, pin := &i, &s, &in
+	sl, isl, bs := []int{1, 2}, []inner{{3}}, []byte("hi")
+	psl := &sl
+	arr, m, mm := [2]string{"a", "b"}, map[string]int{"k": 1}, map[string]string{"x": "y"}
+	pmm := &mm
+	ppmm := &pmm
+	var nilInt *int
+	var nilMap **map[string]string
+	esc := []string{"a\"b\n", "c"}
+
+	// nil slices are written as [] rather than null, so they're left out
+	tests := []shapes{
+		{Elems: []**int{}, PtrSlices: []*[]int{}},
+		{
+			Slice: &sl, StructSlice: &isl, Bytes: &bs, Array: &arr, Map: &m,
+			PtrInt: &pi, PtrString: &ps, PtrStruct: &pin, PtrSlice: &psl, PtrPtrMap: &ppmm,
+			Elems: []**int{&pi, &nilInt, nil}, PtrSlices: []*[]int{&sl, nil}, Escaped: &esc,
+		},
+		{PtrInt: &nilInt, PtrPtrMap: &nilMap, Elems: []**int{}, PtrSlices: []*[]int{}},
+	}
+
+	enc := NewStructEncoder(shapes{})
+
+	for _, v := range tests {
+		want, _ := json.Marshal(v)
+
+		buf := NewBufferFromPool()
+		enc.Marshal(&v, buf)
+
+		if string(want) != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+}
+
+// chunkWriter records the size of each write it's given, failing once it's been given fail writes
+type chunkWriter struct {
+	bytes.Buffer
+	writes []int
+	fail   int
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	if c.fail > 0 && len(c.writes) == c.fail {
+		return 0, io.ErrShortWrite
+	}
+	c.writes = append(c.writes, len(b))
+	return c.Buffer.Write(b)
+}
+
+func Test_StreamingBuffer(t *testing.T) {
+
+	type row struct {
+		ID    int               `json:"id"`
+		Name  string            `json:"name"`
+		Tags  map[string]string `json:"tags"`
+		Valid bool              `json:"valid"`
+	}
+
+	rows := make([]row, 1000)
+	for i := range rows {
+		rows[i] = row{ID: i, Name: "row " + strconv.Itoa(i), Tags: map[string]string{"b": "2", "a": "1"}, Valid: i%2 == 0}
+	}
+
+	enc := NewSliceEncoder([]row{})
+
+	want := NewBufferFromPool()
+	defer want.ReturnToPool()
+	enc.Marshal(&rows, want)
+
+	cw := &chunkWriter{}
+	buf := NewStreamingBuffer(cw, 1024)
+	enc.Marshal(&rows, buf)
+	if err := buf.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want.String() != cw.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want.Bytes, cw.Bytes())
+	}
+	if len(cw.writes) < len(want.Bytes)/1024 {
+		t.Errorf("want at least %d writes, got %d", len(want.Bytes)/1024, len(cw.writes))
+	}
+	for _, n := range cw.writes[:len(cw.writes)-1] {
+		if n < 1024 || n > 1024+128 {
+			t.Errorf("want writes of about 1024 bytes, got %d", n)
+		}
+	}
+
+	// the first error is kept, and nothing more is written
+	cw = &chunkWriter{fail: 2}
+	buf = NewStreamingBuffer(cw, 1024)
+	enc.Marshal(&rows, buf)
+	if err := buf.Flush(); err != io.ErrShortWrite || buf.Err() != io.ErrShortWrite {
+		t.Errorf("want %v, got %v and %v", io.ErrShortWrite, err, buf.Err())
+	}
+	if len(cw.writes) != 2 || len(buf.Bytes) != 0 {
+		t.Errorf("want 2 writes and an empty buffer, got %d writes and %d bytes", len(cw.writes), len(buf.Bytes))
+	}
+
+	// numbers never go through Write, so slices and arrays of them need to flush between elements
+	ints := make([]int, 10000)
+	for i := range ints {
+		ints[i] = i
+	}
+	var floats [1000]float64
+	for i := range floats {
+		floats[i] = float64(i) / 4
+	}
+
+	numeric := map[string]func(*Buffer){
+		"slice": func(w *Buffer) { NewSliceEncoder([]int{}).Marshal(&ints, w) },
+		"array": func(w *Buffer) { NewArrayEncoder([1000]float64{}).Marshal(floats, w) },
+	}
+	for name, marshal := range numeric {
+		want.Reset()
+		marshal(want)
+		cw = &chunkWriter{}
+		buf = NewStreamingBuffer(cw, 1024)
+		marshal(buf)
+		if held := len(buf.Bytes); held > 1024+64 {
+			t.Errorf("%s: want no more than about 1024 bytes held, got %d", name, held)
+		}
+		if err := buf.Flush(); err != nil || want.String() != cw.String() {
+			t.Errorf("%s: want:\n%s\ngot %v:\n%s", name, want.Bytes, err, cw.Bytes())
+		}
+	}
+
+	// buffers which aren't streaming never flush
+	if err := want.Flush(); err != nil || len(want.Bytes) == 0 {
+		t.Errorf("want nothing flushed, got %v with %d bytes left", err, len(want.Bytes))
+	}
+}
+
+func Test_RecordWriter(t *testing.T) {
+
+	type event struct {
+		ID   int    `json:"id"`
+		Kind string `json:"kind"`
+	}
+
+	events := []event{{1, "created"}, {2, "updated"}, {3, "deleted"}}
+	ndjson := "{\"id\":1,\"kind\":\"created\"}\n{\"id\":2,\"kind\":\"updated\"}\n{\"id\":3,\"kind\":\"deleted\"}\n"
+
+	sources := map[string]func(*RecordWriter[event]) error{
+		"slice": func(r *RecordWriter[event]) error {
+			return r.WriteSlice(events)
+		},
+		"chan": func(r *RecordWriter[event]) error {
+			c := make(chan event, 1)
+			go func() {
+				for _, e := range events {
+					c <- e
+				}
+				close(c)
+			}()
+			return r.WriteChan(c)
+		},
+		"seq": func(r *RecordWriter[event]) error {
+			return r.WriteSeq(func(yield func(event) bool) {
+				for _, e := range events {
+					if !yield(e) {
+						return
+					}
+				}
+			})
+		},
+		"single": func(r *RecordWriter[event]) error {
+			for i := range events {
+				if err := r.Write(&events[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+
+	for name, write := range sources {
+		var out bytes.Buffer
+		r := NewRecordWriter[event](&out, NDJSON, 0)
+		if err := write(r); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := r.Flush(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ndjson != out.String() {
+			t.Errorf("%s\nwant:\n%s\ngot:\n%s", name, ndjson, out.String())
+		}
+	}
+
+	// RFC 7464, with a nil record
+	var out bytes.Buffer
+	r := NewRecordWriter[event](&out, JSONSeq, 0)
+	r.Write(&events[0])
+	r.Write(nil)
+	r.Flush()
+	if want := "\x1e{\"id\":1,\"kind\":\"created\"}\n\x1enull\n"; want != out.String() {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, out.String())
+	}
+
+	// records of numbers never call Write, but are flushed all the same
+	cw := &chunkWriter{}
+	ints := NewRecordWriter[int](cw, NDJSON, 64)
+	ints.WriteSlice(make([]int, 100))
+	if len(cw.writes) != 3 {
+		t.Errorf("want 3 writes of 64 bytes, got %v", cw.writes)
+	}
+
+	// errors from JSONEncoderE are returned
+	type encoded struct {
+		E encoderE `json:"e,encoder"`
+	}
+	out.Reset()
+	failing := NewRecordWriter[encoded](&out, NDJSON, 0)
+	err := failing.WriteSlice([]encoded{{}, {encoderE{fail: true}}, {}})
+	if !errors.Is(err, errEncode) {
+		t.Errorf("want %v, got %v", errEncode, err)
+	}
+
+	// the failing record is dropped, leaving the next to be written cleanly
+	failing.Write(&encoded{})
+	failing.Flush()
+	if want := "{\"e\":\"encoderE\"}\n{\"e\":\"encoderE\"}\n"; want != out.String() {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, out.String())
+	}
+
+	// unless part of it has been flushed already, when it's cut short instead
+	type long struct {
+		Name string   `json:"name"`
+		E    encoderE `json:"e,encoder"`
+	}
+	out.Reset()
+	cut := NewRecordWriter[long](&out, JSONSeq, 16)
+	cut.Write(&long{"first", encoderE{}})
+	cut.Write(&long{"a name long enough to be flushed", encoderE{fail: true}})
+	cut.Write(&long{"last", encoderE{}})
+	cut.Flush()
+	if want := "\x1e{\"name\":\"first\",\"e\":\"encoderE\"}\n\x1e{\"name\":\"a name long enough to be flushed\",\"e\":\n\x1e{\"name\":\"last\",\"e\":\"encoderE\"}\n"; want != out.String() {
+		t.Errorf("\nwant:\n%q\ngot:\n%q", want, out.String())
+	}
+
+	// as are errors from the writer, which stop a sequence early
+	cw = &chunkWriter{fail: 1}
+	yielded := 0
+	ints = NewRecordWriter[int](cw, NDJSON, 4)
+	err = ints.WriteSeq(func(yield func(int) bool) {
+		for i := 0; i < 100; i++ {
+			yielded++
+			if !yield(i) {
+				return
+			}
+		}
+	})
+	if err != io.ErrShortWrite || yielded != 4 {
+		t.Errorf("want %v after 4 records, got %v after %d", io.ErrShortWrite, err, yielded)
+	}
+}
+
+type ifaceNode struct {
+	Name string      `json:"name"`
+	Next interface{} `json:"next"`
+}
+
+func Test_GuardsThroughInterfaces(t *testing.T) {
+
+	n := &ifaceNode{Name: "a"}
+	n.Next = &ifaceNode{Name: "b", Next: n}
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	// the path carries on through the interfaces, to wherever the cycle was found. the root isn't tracked, so
+	// that's the second time round
+	var me *MarshalerError
+	err := NewStructEncoder(ifaceNode{}, DetectCycles()).MarshalE(n, buf)
+	if !errors.As(err, &me) || !errors.Is(err, ErrCycle) || me.Path != "ifaceNode.Next.Next.Next" {
+		t.Errorf("want %v at ifaceNode.Next.Next.Next, got %v", ErrCycle, err)
+	}
+
+	// errors without a path leave it out
+	if want := "jingo: error encoding jingo.ifaceNode: pointer cycle detected"; want != (&MarshalerError{Type: reflect.TypeOf(ifaceNode{}), Err: ErrCycle}).Error() {
+		t.Errorf("want %q", want)
+	}
+}
+
+type mapNode struct {
+	Name     string              `json:"name"`
+	Children map[string]*mapNode `json:"children"`
+}
+
+func Test_GuardsThroughMaps(t *testing.T) {
+
+	n := &mapNode{Name: "a"}
+	n.Children = map[string]*mapNode{"self": n}
+
+	want := `{"name":"a","children":{"self":{"name":"a","children":{"self":null}}}}`
+
+	for _, opts := range [][]Option{{DetectCycles()}, {MaxDepth(1)}, {DetectCycles(), MaxDepth(5)}} {
+		enc := NewStructEncoder(mapNode{}, opts...)
+
+		buf := NewBufferFromPool()
+		err := enc.MarshalE(n, buf)
+		if !errors.Is(err, ErrCycle) && !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("want a cycle or depth error, got %v", err)
+		}
+
+		buf.Reset()
+		enc.Marshal(n, buf)
+		if want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+		}
+		if buf.depth != 0 || len(buf.visiting) != 0 {
+			t.Errorf("buffer left at depth %d with %d visiting", buf.depth, len(buf.visiting))
+		}
+		buf.ReturnToPool()
+	}
+}
+
+func Test_MarshalEThroughMaps(t *testing.T) {
+
+	type value struct {
+		E encoderE `json:"e,encoder"`
+	}
+	type withMap struct {
+		M map[string]value `json:"m"`
+	}
+
+	enc := NewStructEncoder(withMap{})
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	v := withMap{M: map[string]value{"a": {}, "b": {encoderE{fail: true}}}}
+	err := enc.MarshalE(&v, buf)
+
+	var me *MarshalerError
+	if !errors.As(err, &me) || !errors.Is(err, errEncode) || me.Path != "withMap.M{}.E" {
+		t.Fatalf("want %v at withMap.M{}.E, got %v", errEncode, err)
+	}
+
+	// the map's state went back to the pool in one piece, so the encoder carries on as normal
+	buf.Reset()
+	v.M["b"] = value{}
+	if err := enc.MarshalE(&v, buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"m":{"a":{"e":"encoderE"},"b":{"e":"encoderE"}}}`; want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+// zeroText writes itself, and says for itself when it's empty
+type zeroText struct {
+	s string
+}
+
+func (z zeroText) MarshalText() ([]byte, error) { return []byte(z.s), nil }
+func (z zeroText) IsZero() bool                 { return z.s == "" }
+
+func Test_OmitEmptySelfWriting(t *testing.T) {
+
+	type selfWriting struct {
+		Addr     netip.Addr     `json:"addr,omitempty"`
+		Name     registeredName `json:"name,omitempty"`
+		Zero     zeroText       `json:"zero,omitempty"`
+		Text     zeroText       `json:"text,omitempty"`
+		Time     time.Time      `json:"time,omitempty"`
+		Children int            `json:"children"`
+	}
+
+	v := selfWriting{
+		Addr: netip.MustParseAddr("1.2.3.4"),
+		Text: zeroText{"text"},
+	}
+
+	// netip.Addr and registeredName have no IsZero, so are never empty
+	want := `{"addr":"1.2.3.4","name":" ","text":"text","children":0}`
+
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	NewStructEncoder(selfWriting{}).Marshal(&v, buf)
+	if want != buf.String() {
+		t.Errorf("\nwant:\n%s\ngot:\n%s", want, buf.Bytes)
+	}
+}
+
+type omitOuter struct {
+	Name  string    `json:"name,omitempty"`
+	Inner omitInner `json:"inner,omitempty"`
+}
+
+// omitInner promotes omitOuter's fields, including one of its own type
+type omitInner struct {
+	*omitOuter
+}
+
+func Test_OmitEmptyRecursive(t *testing.T) {
+
+	enc := NewStructEncoder(omitOuter{})
+
+	tests := []struct {
+		v    omitOuter
+		want string
+	}{
+		{omitOuter{Name: "a"}, `{"name":"a"}`},
+		{omitOuter{Name: "a", Inner: omitInner{&omitOuter{}}}, `{"name":"a"}`},
+		{omitOuter{Name: "a", Inner: omitInner{&omitOuter{Name: "b"}}}, `{"name":"a","inner":{"name":"b"}}`},
+	}
+
+	for _, tt := range tests {
+		buf := NewBufferFromPool()
+		enc.Marshal(&tt.v, buf)
+		if tt.want != buf.String() {
+			t.Errorf("\nwant:\n%s\ngot:\n%s", tt.want, buf.Bytes)
+		}
+		buf.ReturnToPool()
+	}
+}
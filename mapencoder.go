@@ -0,0 +1,209 @@
+package jingo
+
+// mapencoder.go manages MapEncoder and its responsibilities.
+// Maps can't be walked with pointer arithmetic like structs and slices can, so MapEncoder leans
+// on reflect to iterate at runtime. Keys and values are still written by instructions compiled
+// up-front, and the scratch state needed while iterating is pooled per encoder to keep
+// allocations down. Entries are sorted by key to match the output of encoding/json.
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// MapEncoder stores a set of instructions for building a JSON document from a map at runtime.
+type MapEncoder struct {
+	opts  options
+	tt    reflect.Type
+	key    func(unsafe.Pointer, *Buffer) // writes a key as it is, unquoted and unescaped, so it can be sorted by
+	escape func(string, *Buffer)         // escapes a key as it's written out
+	value  func(unsafe.Pointer, *Buffer) // writes a value
+	state  sync.Pool                     // *mapState
+}
+
+// mapState holds everything a single Marshal needs while iterating a map
+type mapState struct {
+	it      reflect.MapIter
+	k, v    reflect.Value  // settable holders we copy each entry into
+	kp, vp  unsafe.Pointer // addresses of the holders
+	buf     Buffer         // entries are written here first so they can be sorted
+	entries []mapEntry
+}
+
+// mapEntry marks out where an entry's key and value sit in mapState.buf
+type mapEntry struct {
+	start, value, end int
+}
+
+// Marshal executes the instructions built up by NewMapEncoder. s needs to be a pointer to the map.
+func (e *MapEncoder) Marshal(s interface{}, w *Buffer) {
+
+	p := (*(*iface)(unsafe.Pointer(&s))).Data
+
+	m := reflect.NewAt(e.tt, p).Elem()
+	if m.IsNil() {
+		w.Write(null)
+		return
+	}
+
+	st := e.state.Get().(*mapState)
+	defer e.release(st) // MarshalE unwinds straight past us when a value fails
+	st.buf.Reset()
+	st.entries = st.entries[:0]
+
+	/// entries are written to our own buffer, so it carries on from where w is in MarshalE and the checks for
+	/// MaxDepth and DetectCycles
+	st.buf.strict, st.buf.depth, st.buf.visiting = w.strict, w.depth, w.visiting
+
+	st.it.Reset(m)
+	for st.it.Next() {
+		st.k.SetIterKey(&st.it)
+		st.v.SetIterValue(&st.it)
+
+		start := len(st.buf.Bytes)
+		e.key(st.kp, &st.buf)
+		value := len(st.buf.Bytes)
+		e.value(st.vp, &st.buf)
+
+		st.entries = append(st.entries, mapEntry{start, value, len(st.buf.Bytes)})
+	}
+	w.visiting = st.buf.visiting // keeping anything it's grown into
+
+	sort.Sort(st)
+
+	w.WriteByte('{')
+	for i, en := range st.entries {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		key := st.buf.Bytes[en.start:en.value]
+		w.WriteByte('"')
+		e.escape(*(*string)(unsafe.Pointer(&key)), w)
+		w.WriteString(`":`)
+		w.Write(st.buf.Bytes[en.value:en.end])
+	}
+	w.WriteByte('}')
+}
+
+// release puts st back in the pool
+func (e *MapEncoder) release(st *mapState) {
+	st.it.Reset(reflect.Value{}) // don't hold on to the map whilst pooled
+	st.buf.visiting = nil
+	e.state.Put(st)
+}
+
+// NewMapEncoder builds a new MapEncoder
+func NewMapEncoder(t interface{}, opts ...Option) *MapEncoder {
+	return newMapEncoder(t, newOptions(opts))
+}
+
+func newMapEncoder(t interface{}, o options) *MapEncoder {
+	tt := reflect.TypeOf(t)
+
+	/// recursive types share the encoder already being compiled for them
+	if enc, ok := sharedEncoder(tt, &o); ok {
+		return enc.(*MapEncoder)
+	}
+
+	e := &MapEncoder{opts: o}
+	defer share(tt, o, e)()
+
+	e.tt = tt
+	e.key = mapKeyInstr(e.tt.Key(), e.opts)
+	e.escape = escapeStringToBuf
+	if e.opts.escapeHTML {
+		e.escape = htmlEscapeStringToBuf
+	}
+	e.opts.path += "{}" // and the rest is for the values
+	e.value = typeInstr(e.tt.Elem(), e.opts)
+
+	e.state.New = func() interface{} {
+		st := &mapState{
+			k: reflect.New(e.tt.Key()).Elem(),
+			v: reflect.New(e.tt.Elem()).Elem(),
+		}
+		st.kp = unsafe.Pointer(st.k.UnsafeAddr())
+		st.vp = unsafe.Pointer(st.v.UnsafeAddr())
+		return st
+	}
+
+	return e
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// mapKeyInstr creates the instruction for writing a map key. As with encoding/json, string kinds are used
+// as they are, then encoding.TextMarshaler implementations, then integer kinds. Keys are written unquoted and
+// unescaped, as encoding/json sorts by the keys themselves, and escaped once sorted. Errors from MarshalText are
+// passed to the buffer, leaving an empty key should it carry on.
+func mapKeyInstr(t reflect.Type, o options) func(unsafe.Pointer, *Buffer) {
+
+	path := o.path
+
+	switch {
+	case t.Kind() == reflect.String:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.WriteString(*(*string)(v))
+		}
+
+	case reflect.PtrTo(t).Implements(textMarshalerType):
+		return func(v unsafe.Pointer, w *Buffer) {
+			b, err := reflect.NewAt(t, v).Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+				return
+			}
+			w.Write(b)
+		}
+
+	case t.Implements(textMarshalerType):
+		return func(v unsafe.Pointer, w *Buffer) {
+			tm := reflect.NewAt(t, v).Elem().Interface().(encoding.TextMarshaler)
+			if reflect.ValueOf(tm).IsNil() {
+				return
+			}
+			b, err := tm.MarshalText()
+			if err != nil {
+				w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+				return
+			}
+			w.Write(b)
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Int,
+		reflect.Int8,
+		reflect.Int16,
+		reflect.Int32,
+		reflect.Int64,
+		reflect.Uint,
+		reflect.Uint8,
+		reflect.Uint16,
+		reflect.Uint32,
+		reflect.Uint64:
+		return typeconv[t.Kind()]
+	}
+
+	unsupported(t, o, "map keys must be strings, integers or implement encoding.TextMarshaler")
+	return nil
+}
+
+// sort.Interface over the entries, ordered by their keys
+
+func (st *mapState) Len() int {
+	return len(st.entries)
+}
+
+func (st *mapState) Less(i, j int) bool {
+	a, b := st.entries[i], st.entries[j]
+	return bytes.Compare(st.buf.Bytes[a.start:a.value], st.buf.Bytes[b.start:b.value]) < 0
+}
+
+func (st *mapState) Swap(i, j int) {
+	st.entries[i], st.entries[j] = st.entries[j], st.entries[i]
+}
@@ -0,0 +1,120 @@
+package jingo
+
+// marshal.go provides Marshal and friends, for when keeping an encoder around for each type is
+// more trouble than it's worth. Instructions are compiled the first time a type is seen and
+// cached by type, in the same way as for interface fields, so after that each call costs a cache
+// lookup on top of using an encoder directly.
+
+import (
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+var defaultCache = dynamicCacheFor(options{})
+
+// Marshal returns the JSON document for v. An error is returned if v's type can't be encoded, or if a
+// JSONEncoderE or JSONMarshalerE field fails.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	if err := marshalToBufE(v, buf); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, len(buf.Bytes))
+	copy(b, buf.Bytes)
+	return b, nil
+}
+
+// MarshalTo writes the JSON document for v to w. An error is returned if v's type can't be encoded, if a
+// JSONEncoderE or JSONMarshalerE field fails, or if writing to w fails.
+func MarshalTo(w io.Writer, v interface{}) error {
+	buf := NewBufferFromPool()
+	defer buf.ReturnToPool()
+
+	if err := marshalToBufE(v, buf); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf.Bytes)
+	return err
+}
+
+// Append appends the JSON document for v to dst and returns the extended slice. Like the encoder constructors,
+// it panics if v's type can't be encoded. As with an encoder's Marshal, errors from JSONEncoderE and JSONMarshalerE
+// fields are ignored.
+func Append(dst []byte, v interface{}) []byte {
+
+	/// borrow a pooled buffer to write into dst, rather than have a new one escape
+	buf := NewBufferFromPool()
+	own := buf.Bytes
+	buf.Bytes = dst
+
+	err := marshalToBuf(v, buf)
+	dst = buf.Bytes
+
+	buf.Bytes = own
+	buf.ReturnToPool()
+
+	if err != nil {
+		panic(err)
+	}
+	return dst
+}
+
+// marshalToBufE is marshalToBuf, additionally returning the first error from a JSONEncoderE or JSONMarshalerE field
+func marshalToBufE(v interface{}, w *Buffer) (err error) {
+	marshalErr := marshalE(w, func() { err = marshalToBuf(v, w) })
+	if err != nil {
+		return err
+	}
+	return marshalErr
+}
+
+// marshalToBuf writes v to the buffer, compiling the instructions for its type if they're not cached already
+func marshalToBuf(v interface{}, w *Buffer) error {
+	if v == nil {
+		w.Write(null)
+		return nil
+	}
+
+	t := reflect.TypeOf(v)
+	p := (*iface)(unsafe.Pointer(&v)).Data
+
+	/// pointers are the common case, and we can go straight to what they point at
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		if p == nil {
+			w.Write(null)
+			return nil
+		}
+		t = t.Elem()
+	}
+
+	d, err := compileDefault(t)
+	if err != nil {
+		return err
+	}
+
+	if d.direct && !ptr {
+		writeHeld(d, p, w)
+		return nil
+	}
+	d.conv(p, w)
+	return nil
+}
+
+// writeHeld writes a value which is held in an interface's data word, rather than pointed to by it. It's kept
+// separate so that only these values pay for p escaping.
+func writeHeld(d *dynamicInstr, p unsafe.Pointer, w *Buffer) {
+	d.conv(unsafe.Pointer(&p), w)
+}
+
+// compileDefault looks up the instruction for t, returning an *UnsupportedTypeError if it can't be compiled.
+// Nothing is cached for types which fail to compile.
+func compileDefault(t reflect.Type) (d *dynamicInstr, err error) {
+	defer recoverUnsupported(&err)
+	return defaultCache.instrFor(t), nil
+}
@@ -0,0 +1,76 @@
+package jingo
+
+// marshaler.go supports types which serialize themselves through json.Marshaler or
+// encoding.TextMarshaler, as many third-party types like uuids and decimals do. Which of the two
+// applies is decided once at compile time, though the call itself is out of our hands - much like
+// `,stringer`, the allocations it makes are down to the implementation.
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"unsafe"
+)
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// isMarshaler reports whether t, or what t points to, implements json.Marshaler or encoding.TextMarshaler
+func isMarshaler(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return marshalerInstr(t, options{}) != nil
+}
+
+// marshalerInstr creates the instruction for writing a value of type t through its json.Marshaler or, failing that,
+// its encoding.TextMarshaler implementation. Methods on either value or pointer receivers are found, as we always
+// hold a pointer to the value. It returns nil when t implements neither. Pointers and interfaces are left to the
+// callers, who dereference and resolve them before getting here. Errors from either method are passed to the buffer,
+// which writes null in their place should it carry on.
+func marshalerInstr(t reflect.Type, o options) func(unsafe.Pointer, *Buffer) {
+
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface {
+		return nil
+	}
+
+	path := o.path
+
+	pt := reflect.PtrTo(t) // includes the methods of both receivers
+
+	switch {
+	case pt.Implements(jsonMarshalerType):
+		validate := o.validateJSON
+		return func(v unsafe.Pointer, w *Buffer) {
+			b, err := reflect.NewAt(t, v).Interface().(json.Marshaler).MarshalJSON()
+			if err != nil {
+				w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+				w.Write(null)
+				return
+			}
+			if len(b) == 0 || (validate && !json.Valid(b)) {
+				w.Write(null)
+				return
+			}
+			w.Write(b)
+		}
+
+	case pt.Implements(textMarshalerType):
+		escape := escapeStringToBuf
+		if o.escapeHTML {
+			escape = htmlEscapeStringToBuf
+		}
+		return func(v unsafe.Pointer, w *Buffer) {
+			b, err := reflect.NewAt(t, v).Interface().(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+				w.Write(null)
+				return
+			}
+			w.WriteByte('"')
+			escape(*(*string)(unsafe.Pointer(&b)), w)
+			w.WriteByte('"')
+		}
+	}
+
+	return nil
+}
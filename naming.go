@@ -0,0 +1,95 @@
+package jingo
+
+// naming.go derives JSON keys from Go field names for the fields which don't name themselves in a
+// tag. Keys are compiled into static chunks, so the conversion is only ever paid for once when
+// the encoder is created.
+
+import (
+	"strings"
+	"unicode"
+)
+
+// NamingStrategy decides the key a field is written under when it's derived from the field's Go name. Names given in
+// a json tag are always used as they are.
+type NamingStrategy int
+
+const (
+	GoName     NamingStrategy = iota // the Go name as it is, e.g HTTPServerID
+	SnakeCase                        // e.g http_server_id
+	CamelCase                        // e.g httpServerId
+	KebabCase                        // e.g http-server-id
+	PascalCase                       // e.g HttpServerId
+)
+
+// Naming makes the encoder derive keys from Go field names with the given strategy. Only fields without a name in
+// their tag are affected, so this is mostly of use alongside StdlibFields, e.g
+// NewStructEncoder(MyPayload{}, jingo.StdlibFields(), jingo.Naming(jingo.SnakeCase))
+func Naming(s NamingStrategy) Option {
+	return func(o *options) {
+		o.naming = s
+	}
+}
+
+// name converts the Go name of a field according to the strategy
+func (s NamingStrategy) name(name string) string {
+
+	if s == GoName {
+		return name
+	}
+
+	var sb strings.Builder
+	for i, word := range splitWords(name) {
+		switch s {
+		case SnakeCase:
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteString(strings.ToLower(word))
+		case KebabCase:
+			if i > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteString(strings.ToLower(word))
+		case CamelCase, PascalCase:
+			if i == 0 && s == CamelCase {
+				sb.WriteString(strings.ToLower(word))
+				continue
+			}
+			r := []rune(strings.ToLower(word))
+			r[0] = unicode.ToUpper(r[0])
+			sb.WriteString(string(r))
+		}
+	}
+	return sb.String()
+}
+
+// splitWords breaks a Go name into its words. A word starts at an upper case letter following a lower case letter or
+// digit, and acronyms end with the letter before a lower case one, so HTTPServerID is split into HTTP, Server and ID.
+// Digits stay with the word before them and underscores separate words without being a part of them.
+func splitWords(name string) []string {
+
+	var words []string
+	r := []rune(name)
+	start := 0
+
+	for i := 0; i < len(r); i++ {
+		switch {
+		case r[i] == '_':
+			if i > start {
+				words = append(words, string(r[start:i]))
+			}
+			start = i + 1
+
+		case i > start && unicode.IsUpper(r[i]) &&
+			(unicode.IsLower(r[i-1]) || unicode.IsDigit(r[i-1]) ||
+				(unicode.IsUpper(r[i-1]) && i+1 < len(r) && unicode.IsLower(r[i+1]))):
+			words = append(words, string(r[start:i]))
+			start = i
+		}
+	}
+
+	if start < len(r) {
+		words = append(words, string(r[start:]))
+	}
+	return words
+}
@@ -0,0 +1,131 @@
+package jingo
+
+// omitempty.go declares the emptiness tests used by the `,omitempty` option. They're resolved
+// once per field at compile time so the only runtime cost is the test itself, and only for
+// fields which have opted in.
+
+import (
+	"reflect"
+	"time"
+	"unsafe"
+)
+
+// isZeroer is implemented by types which can say whether they hold their zero value, like time.Time
+type isZeroer interface {
+	IsZero() bool
+}
+
+var isZeroerType = reflect.TypeOf((*isZeroer)(nil)).Elem()
+
+// emptyFunc returns a function which reports whether the value of type t found at a pointer is empty.
+func emptyFunc(t reflect.Type, o options) func(unsafe.Pointer) bool {
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return func(v unsafe.Pointer) bool { return !*(*bool)(v) }
+	case reflect.Int:
+		return func(v unsafe.Pointer) bool { return *(*int)(v) == 0 }
+	case reflect.Int8:
+		return func(v unsafe.Pointer) bool { return *(*int8)(v) == 0 }
+	case reflect.Int16:
+		return func(v unsafe.Pointer) bool { return *(*int16)(v) == 0 }
+	case reflect.Int32:
+		return func(v unsafe.Pointer) bool { return *(*int32)(v) == 0 }
+	case reflect.Int64:
+		return func(v unsafe.Pointer) bool { return *(*int64)(v) == 0 }
+	case reflect.Uint:
+		return func(v unsafe.Pointer) bool { return *(*uint)(v) == 0 }
+	case reflect.Uint8:
+		return func(v unsafe.Pointer) bool { return *(*uint8)(v) == 0 }
+	case reflect.Uint16:
+		return func(v unsafe.Pointer) bool { return *(*uint16)(v) == 0 }
+	case reflect.Uint32:
+		return func(v unsafe.Pointer) bool { return *(*uint32)(v) == 0 }
+	case reflect.Uint64:
+		return func(v unsafe.Pointer) bool { return *(*uint64)(v) == 0 }
+	case reflect.Float32:
+		return func(v unsafe.Pointer) bool { return *(*float32)(v) == 0 }
+	case reflect.Float64:
+		return func(v unsafe.Pointer) bool { return *(*float64)(v) == 0 }
+	case reflect.String:
+		return func(v unsafe.Pointer) bool { return len(*(*string)(v)) == 0 }
+	case reflect.Slice:
+		return func(v unsafe.Pointer) bool { return (*sliceHeader)(v).Len == 0 }
+	case reflect.Ptr:
+		return func(v unsafe.Pointer) bool { return *(*unsafe.Pointer)(v) == nil }
+	case reflect.Interface:
+		return func(v unsafe.Pointer) bool { return (*iface)(v).Type == nil }
+	case reflect.Map:
+		return func(v unsafe.Pointer) bool { return reflect.NewAt(t, v).Elem().Len() == 0 }
+	case reflect.Array:
+		l := t.Len()
+		return func(v unsafe.Pointer) bool { return l == 0 }
+	case reflect.Struct:
+		return structEmptyFunc(t, o)
+	}
+
+	// anything else is never considered empty
+	return func(v unsafe.Pointer) bool { return false }
+}
+
+// structEmptyFunc treats a struct as empty when every field we'd encode for it is empty itself.
+func structEmptyFunc(t reflect.Type, o options) func(unsafe.Pointer) bool {
+
+	/// time is a struct with no tagged fields, so it needs to go by its own definition of zero
+	if t == timeType {
+		return func(v unsafe.Pointer) bool { return (*time.Time)(v).IsZero() }
+	}
+
+	/// as do other structs which write themselves, as their fields tell us nothing about what gets written. Without an
+	/// IsZero method of their own they're never empty, as with encoding/json
+	if typeEncoderFor(t) != nil || isMarshaler(t) {
+		if reflect.PtrTo(t).Implements(isZeroerType) {
+			return func(v unsafe.Pointer) bool { return reflect.NewAt(t, v).Interface().(isZeroer).IsZero() }
+		}
+		return func(v unsafe.Pointer) bool { return false }
+	}
+
+	type fieldEmpty struct {
+		offset uintptr
+		ptrs   []uintptr
+		empty  func(unsafe.Pointer) bool
+	}
+
+	/// a struct can hold fields of its own type through an embedded pointer, which we'd otherwise build tests for
+	/// forever. So tests are registered before their fields are built, and references back to them share them.
+	if o.compiling == nil {
+		o.compiling = &compiling{encoders: map[encoderKey]interface{}{}}
+	}
+	if o.compiling.empties == nil {
+		o.compiling.empties = map[encoderKey]func(unsafe.Pointer) bool{}
+	}
+	k := encoderKeyFor(t, o)
+	if empty, ok := o.compiling.empties[k]; ok {
+		return empty
+	}
+
+	var fields []fieldEmpty
+	empty := func(v unsafe.Pointer) bool {
+		for _, f := range fields {
+
+			/// fields promoted through a nil embedded pointer are never written, so count as empty
+			p := v
+			for _, off := range f.ptrs {
+				if p = *(*unsafe.Pointer)(unsafe.Pointer(uintptr(p) + off)); p == nil {
+					break
+				}
+			}
+
+			if p != nil && !f.empty(unsafe.Pointer(uintptr(p)+f.offset)) {
+				return false
+			}
+		}
+		return true
+	}
+	o.compiling.empties[k] = empty
+
+	for _, f := range typeFields(t, o) {
+		fields = append(fields, fieldEmpty{f.sf.Offset, f.ptrs, emptyFunc(f.sf.Type, o)})
+	}
+	return empty
+}
@@ -0,0 +1,61 @@
+package jingo
+
+// options.go declares the options which can be passed to the encoder constructors. Options are only
+// consulted during the compile stage, where they select which instructions get built, and they're
+// passed on to any nested encoders created along the way.
+
+// Option configures an encoder as it's being created, e.g NewStructEncoder(MyPayload{}, jingo.EscapeHTML())
+type Option func(*options)
+
+// options is the resolved set of Option. It needs to remain comparable, as it forms part of the key for cached instructions.
+type options struct {
+	escapeHTML   bool
+	validateJSON bool
+	untagged     bool // select fields as encoding/json does
+	naming       NamingStrategy
+	maxDepth     int  // see MaxDepth
+	detectCycles bool // see DetectCycles
+
+	path      string     // where we are in the type being compiled, for errors. always empty once compiled
+	compiling *compiling // the encoders created so far by the constructor being called, see recursion.go
+
+	// formats picked by a field's tag options. these apply to the field and the elements of any slices, arrays
+	// and maps built for it, but not to the fields of nested structs
+	time     timeFormat
+	duration durationFormat
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// EscapeHTML makes the encoder escape every string it writes in the same way as the `,htmlescape` option,
+// so that the output can be safely embedded in HTML. This includes strings nested in other encoders, map keys and field names.
+func EscapeHTML() Option {
+	return func(o *options) {
+		o.escapeHTML = true
+	}
+}
+
+// ValidateJSON makes the encoder check that the output of each json.Marshaler it calls is valid JSON before writing it.
+// Anything which isn't is written as null instead. Output is written verbatim otherwise, so this is worth the cost when
+// the implementations can't be trusted to produce valid documents.
+func ValidateJSON() Option {
+	return func(o *options) {
+		o.validateJSON = true
+	}
+}
+
+// StdlibFields makes the encoder select struct fields in the same way as encoding/json, rather than only those with a
+// json tag. Untagged exported fields are written under their Go names, as are those whose tag has an empty name, e.g
+// `json:",omitempty"`. Fields tagged `json:"-"` and unexported fields are left out, though the exported fields of
+// unexported embedded structs are still promoted. A tag of `json:"-,"` names the field "-".
+func StdlibFields() Option {
+	return func(o *options) {
+		o.untagged = true
+	}
+}
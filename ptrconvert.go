@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strconv"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -32,12 +33,11 @@ var typeconv = map[reflect.Kind]func(unsafe.Pointer, *Buffer){
 var btrue, bfalse = []byte("true"), []byte("false")
 
 func ptrBoolToBuf(v unsafe.Pointer, b *Buffer) {
-	r := *(*bool)(v)
-	if r {
-		b.Write(btrue)
-	} else {
-		b.Write(bfalse)
+	r := bfalse
+	if *(*bool)(v) {
+		r = btrue
 	}
+	b.Write(r)
 }
 
 func ptrIntToBuf(v unsafe.Pointer, b *Buffer) {
@@ -97,44 +97,108 @@ func ptrTimeToBuf(v unsafe.Pointer, b *Buffer) {
 }
 
 func ptrEscapeStringToBuf(v unsafe.Pointer, w *Buffer) {
-	bs := *(*string)(v)
+	escapeStringToBuf(*(*string)(v), w)
+}
+
+func ptrHTMLEscapeStringToBuf(v unsafe.Pointer, w *Buffer) {
+	htmlEscapeStringToBuf(*(*string)(v), w)
+}
+
+const hex = "0123456789abcdef"
+
+// escapeSafe marks the ascii characters which can be written as they are inside a JSON string
+var escapeSafe = func() (safe [utf8.RuneSelf]bool) {
+	for c := ' '; c < utf8.RuneSelf; c++ {
+		safe[c] = c != '"' && c != '\\'
+	}
+	return safe
+}()
+
+// htmlEscapeSafe is escapeSafe less the characters which are significant to HTML
+var htmlEscapeSafe = func() (safe [utf8.RuneSelf]bool) {
+	safe = escapeSafe
+	safe['<'], safe['>'], safe['&'] = false, false, false
+	return safe
+}()
+
+// escapeStringToBuf writes s to the buffer as the body of a JSON string, as per RFC 8259. '"', '\\' and all
+// control characters are escaped, and invalid UTF-8 is replaced with U+FFFD, in the same way as encoding/json.
+func escapeStringToBuf(s string, w *Buffer) {
+	escapeToBuf(s, w, &escapeSafe, false)
+}
+
+// htmlEscapeStringToBuf is escapeStringToBuf which additionally escapes '<', '>', '&', U+2028 and U+2029, so
+// that the output is safe to embed in HTML <script> tags and JSONP. Again, this mirrors encoding/json.
+func htmlEscapeStringToBuf(s string, w *Buffer) {
+	escapeToBuf(s, w, &htmlEscapeSafe, true)
+}
+
+func escapeToBuf(s string, w *Buffer, safe *[utf8.RuneSelf]bool, html bool) {
 
 	pos := 0
-	for i := 0; i < len(bs); i++ {
-		switch bs[i] {
-		case '\\', '"':
-			if pos < i {
-				w.WriteString(bs[pos:i])
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		if c < utf8.RuneSelf {
+			if safe[c] {
+				i++
+				continue
 			}
-			pos = i + 1
 
-			w.WriteByte('\\')
-			w.WriteByte(bs[i])
-		case '\n':
 			if pos < i {
-				w.WriteString(bs[pos:i])
+				w.WriteString(s[pos:i])
+			}
+
+			switch c {
+			case '\\', '"':
+				w.WriteByte('\\')
+				w.WriteByte(c)
+			case '\n':
+				w.WriteString(`\n`)
+			case '\r':
+				w.WriteString(`\r`)
+			case '\t':
+				w.WriteString(`\t`)
+			default:
+				w.WriteString(`\u00`)
+				w.WriteByte(hex[c>>4])
+				w.WriteByte(hex[c&0xF])
 			}
-			pos = i + 1
 
-			w.WriteString(`\n`)
-		case '\r':
+			i++
+			pos = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
 			if pos < i {
-				w.WriteString(bs[pos:i])
+				w.WriteString(s[pos:i])
 			}
-			pos = i + 1
+			w.WriteString(`\ufffd`)
 
-			w.WriteString(`\r`)
-		case '\t':
+			i += size
+			pos = i
+			continue
+		}
+
+		/// line and paragraph separators are valid JSON, but not valid javascript
+		if html && (r == '\u2028' || r == '\u2029') {
 			if pos < i {
-				w.WriteString(bs[pos:i])
+				w.WriteString(s[pos:i])
 			}
-			pos = i + 1
+			w.WriteString(`\u202`)
+			w.WriteByte(hex[r&0xF])
 
-			w.WriteString(`\t`)
+			i += size
+			pos = i
+			continue
 		}
+
+		i += size
 	}
 
-	if pos < len(bs) {
-		w.WriteString(bs[pos:])
+	if pos < len(s) {
+		w.WriteString(s[pos:])
 	}
 }
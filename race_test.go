@@ -0,0 +1,7 @@
+//go:build race
+
+package jingo
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,134 @@
+package jingo
+
+// recordwriter.go writes streams of records, one JSON document per value, as used for event
+// streams and exports. Each value is written by the same instruction a SliceEncoder would compile
+// for its elements, followed by the record's delimiters, and the output is streamed to an
+// io.Writer as it goes rather than held in memory.
+
+import (
+	"io"
+	"unsafe"
+)
+
+// RecordFormat decides how the records written by a RecordWriter are delimited
+type RecordFormat int
+
+const (
+	NDJSON  RecordFormat = iota // newline-delimited JSON, each record followed by '\n'
+	JSONSeq                     // JSON text sequences as per RFC 7464, each record preceded by 0x1E and followed by '\n'
+)
+
+// RecordWriter writes values of type T to an io.Writer as a stream of records. Create one with NewRecordWriter.
+type RecordWriter[T any] struct {
+	conv   func(unsafe.Pointer, *Buffer)
+	format RecordFormat
+	buf    *Buffer
+	start  int // where the record being written starts, counting what's already been flushed
+}
+
+// NewRecordWriter builds a new RecordWriter which writes records of type T to w in the given format. Records are
+// buffered and flushed to w each time flushAt bytes have built up, as with NewStreamingBuffer, so a flushAt of 0 or
+// less uses the default. Call Flush once you're done writing to send what's left. It panics with an
+// *UnsupportedTypeError if T can't be encoded.
+func NewRecordWriter[T any](w io.Writer, format RecordFormat, flushAt int, opts ...Option) *RecordWriter[T] {
+	return &RecordWriter[T]{
+		conv:   NewEncoder[T](opts...).conv,
+		format: format,
+		buf:    NewStreamingBuffer(w, flushAt),
+	}
+}
+
+// Write writes v as a single record. A nil v is written as null.
+func (r *RecordWriter[T]) Write(v *T) error {
+	return r.write(func() {
+		r.record(unsafe.Pointer(v))
+	})
+}
+
+// WriteSlice writes each element of s as a record.
+func (r *RecordWriter[T]) WriteSlice(s []T) error {
+	return r.write(func() {
+		for i := range s {
+			if r.buf.err != nil {
+				return
+			}
+			r.record(unsafe.Pointer(&s[i]))
+		}
+	})
+}
+
+// WriteChan writes each value received from c as a record, until c is closed. Whatever's been buffered is flushed
+// whenever c has nothing waiting, so records aren't held back whilst waiting on the sender.
+func (r *RecordWriter[T]) WriteChan(c <-chan T) error {
+	return r.write(func() {
+		var v T
+		for v = range c {
+			r.record(unsafe.Pointer(&v))
+			if len(c) == 0 {
+				r.buf.Flush()
+			}
+			if r.buf.err != nil {
+				return
+			}
+		}
+	})
+}
+
+// WriteSeq writes each value yielded by seq as a record, stopping it early should writing fail. It accepts an
+// iter.Seq[T].
+func (r *RecordWriter[T]) WriteSeq(seq func(yield func(T) bool)) error {
+	return r.write(func() {
+		var v T
+		seq(func(t T) bool {
+			v = t
+			r.record(unsafe.Pointer(&v))
+			return r.buf.err == nil
+		})
+	})
+}
+
+// Flush writes any records still buffered to the underlying writer, and returns the first error it's returned.
+func (r *RecordWriter[T]) Flush() error {
+	return r.buf.Flush()
+}
+
+// write runs the records written by w as MarshalE does, so the first error from a JSONEncoderE or JSONMarshalerE is
+// returned as a *MarshalerError, and the failing record is discarded. Otherwise the first error from the underlying
+// writer is returned.
+func (r *RecordWriter[T]) write(w func()) error {
+	if err := marshalE(r.buf, w); err != nil {
+		r.discard()
+		return err
+	}
+	return r.buf.err
+}
+
+// discard drops what was written of a record which failed part way through, so the records written after it aren't
+// run into it. Should some of it have been flushed already it can't be taken back, so it's ended with a newline
+// instead, leaving a line of invalid JSON in its place which readers of either format can skip.
+func (r *RecordWriter[T]) discard() {
+	if at := r.start - r.buf.flushed; at >= 0 {
+		r.buf.Bytes = r.buf.Bytes[:at]
+		return
+	}
+	r.buf.WriteByte('\n')
+}
+
+// record writes the value of type T at v as a record, then flushes the buffer if it's reached its threshold. Records
+// of numbers can be written without calling Write at all, so can't rely on it to flush.
+func (r *RecordWriter[T]) record(v unsafe.Pointer) {
+	r.start = r.buf.flushed + len(r.buf.Bytes)
+
+	if r.format == JSONSeq {
+		r.buf.WriteByte(0x1E)
+	}
+
+	if v == nil {
+		r.buf.Write(null)
+	} else {
+		r.conv(v, r.buf)
+	}
+
+	r.buf.WriteByte('\n')
+	r.buf.stream()
+}
@@ -0,0 +1,55 @@
+package jingo
+
+// recursion.go lets recursive types compile. A type can refer back to itself through any number of
+// pointers, slices, arrays and maps - think tree nodes with `Children []Node`, or A -> *B -> *A - and
+// compiling each reference afresh would never end. Instead every encoder created whilst compiling a
+// type is registered whilst its own contents are compiled, so a reference back to it finds the
+// encoder already there and shares it. Once compiled it's unregistered again, as the encoder carries
+// the paths for where it was compiled, and references to the type found elsewhere need their own.
+// The registry is only used at compile time, so costs nothing when marshaling.
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// compiling is the registry of encoders still being created by a single call to one of the encoder constructors.
+// It's carried along in options, so every encoder compiled along the way shares it.
+type compiling struct {
+	encoders map[encoderKey]interface{} // *StructEncoder, *SliceEncoder, *ArrayEncoder or *MapEncoder
+
+	// the omitempty tests built for structs, which can refer back to themselves through embedded pointers in the same
+	// way. They carry no paths, so are kept for the whole call.
+	empties map[encoderKey]func(unsafe.Pointer) bool
+}
+
+// encoderKey identifies an encoder by the type it encodes and the options it was compiled with, as the same type can
+// be compiled differently when the options differ
+type encoderKey struct {
+	t reflect.Type
+	o options
+}
+
+func encoderKeyFor(t reflect.Type, o options) encoderKey {
+	o.path, o.compiling = "", nil // neither change which instructions get compiled
+	return encoderKey{t, o}
+}
+
+// sharedEncoder returns the encoder already registered for t with the options o. A new registry is started in o if
+// it doesn't carry one yet.
+func sharedEncoder(t reflect.Type, o *options) (interface{}, bool) {
+	if o.compiling == nil {
+		o.compiling = &compiling{encoders: map[encoderKey]interface{}{}}
+	}
+	enc, ok := o.compiling.encoders[encoderKeyFor(t, *o)]
+	return enc, ok
+}
+
+// share registers enc as the encoder for t with the options o whilst it's compiled. It must be called before anything
+// is compiled for enc, so that any references back to t find it, and the func it returns called once enc is compiled
+// or has failed to be.
+func share(t reflect.Type, o options, enc interface{}) func() {
+	k := encoderKeyFor(t, o)
+	o.compiling.encoders[k] = enc
+	return func() { delete(o.compiling.encoders, k) }
+}
@@ -0,0 +1,38 @@
+package jingo
+
+// registry.go lets callers plug in their own conversion for a type, to be used wherever it's
+// found. Registered conversions are looked up whilst compiling, so they cost nothing extra at
+// runtime compared to the built-in conversions in ptrconvert.go.
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+var typeEncoders sync.Map // reflect.Type -> func(unsafe.Pointer, *Buffer)
+
+// RegisterTypeEncoder registers conv as the way to write values of type t. conv is passed a pointer to the value and
+// must write a complete JSON value, quotes included. It's used wherever t appears - fields, pointers, slice and array
+// elements and map values - unless a field's tag options say otherwise. Encoders only pick up the conversions
+// registered before they're created, so it's best to register them from init.
+func RegisterTypeEncoder(t reflect.Type, conv func(unsafe.Pointer, *Buffer)) {
+	typeEncoders.Store(t, conv)
+}
+
+// RegisterEncoder is the type-safe equivalent of RegisterTypeEncoder, e.g
+//
+//	jingo.RegisterEncoder(func(v *netip.Addr, w *jingo.Buffer) { ... })
+func RegisterEncoder[T any](conv func(*T, *Buffer)) {
+	RegisterTypeEncoder(reflect.TypeOf((*T)(nil)).Elem(), func(v unsafe.Pointer, w *Buffer) {
+		conv((*T)(v), w)
+	})
+}
+
+// typeEncoderFor returns the conversion registered for t, or nil if there isn't one
+func typeEncoderFor(t reflect.Type) func(unsafe.Pointer, *Buffer) {
+	if conv, ok := typeEncoders.Load(t); ok {
+		return conv.(func(unsafe.Pointer, *Buffer))
+	}
+	return nil
+}
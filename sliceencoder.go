@@ -14,6 +14,7 @@ import (
 
 // SliceEncoder stores a set of instructions for building a JSON document from a slice at runtime.
 type SliceEncoder struct {
+	opts        options
 	instruction func(t unsafe.Pointer, w *Buffer)
 	tt          reflect.Type
 	offset      uintptr
@@ -26,20 +27,82 @@ func (e *SliceEncoder) Marshal(s interface{}, w *Buffer) {
 	e.instruction(p, w)
 }
 
-// NewSliceEncoder builds a new SliceEncoder
-func NewSliceEncoder(t interface{}) *SliceEncoder {
-	e := &SliceEncoder{}
+// MarshalE is Marshal, but stops at the first error returned by a JSONEncoderE or JSONMarshalerE field, or by
+// MarshalJSON or MarshalText, and returns it as a *MarshalerError. It also returns an *UnsupportedTypeError for any type found in an interface which can't be
+// encoded, rather than panicking. Whatever was written up to that point is left in the buffer.
+func (e *SliceEncoder) MarshalE(s interface{}, w *Buffer) error {
+	return marshalE(w, func() { e.Marshal(s, w) })
+}
+
+// NewSliceEncoder builds a new SliceEncoder. It panics with an *UnsupportedTypeError if the elements can't be encoded.
+func NewSliceEncoder(t interface{}, opts ...Option) *SliceEncoder {
+	return newSliceEncoder(t, newOptions(opts))
+}
+
+// NewSliceEncoderE is NewSliceEncoder, but returns an *UnsupportedTypeError rather than panicking.
+func NewSliceEncoderE(t interface{}, opts ...Option) (enc *SliceEncoder, err error) {
+	defer recoverUnsupported(&err)
+	return newSliceEncoder(t, newOptions(opts)), nil
+}
+
+func newSliceEncoder(t interface{}, o options) *SliceEncoder {
+	tt := reflect.TypeOf(t)
+
+	/// recursive types share the encoder already being compiled for them
+	if enc, ok := sharedEncoder(tt, &o); ok {
+		return enc.(*SliceEncoder)
+	}
 
-	e.tt = reflect.TypeOf(t)
+	e := &SliceEncoder{opts: o}
+	defer share(tt, o, e)()
+	e.opts.path += "[]" // everything we compile is for the elements
+
+	e.tt = tt
 	e.offset = e.tt.Elem().Size()
 
+	/// conversions registered for the element type come before any we'd pick
+	if conv := typeEncoderFor(e.tt.Elem()); conv != nil {
+		e.convInstr(conv)
+		return e
+	}
+	if e.tt.Elem().Kind() == reflect.Ptr {
+		if conv := typeEncoderFor(e.tt.Elem().Elem()); conv != nil {
+			e.ptrConvInstr(conv)
+			return e
+		}
+	}
+
+	/// a byte slice is written as a base64 string rather than an array
+	if isBytes(e.tt) {
+		e.instruction = ptrBase64ToBuf
+		return e
+	}
+
 	// see if we can select based on a specific type
 	switch e.tt.Elem() {
 	case timeType:
+		if e.opts.time != (timeFormat{}) {
+			e.convInstr(timeInstr(e.opts.time))
+			return e
+		}
 		e.timeInstr()
 		return e
+	case durationType:
+		if e.opts.duration != durationNanos {
+			e.convInstr(durationInstr(e.opts.duration))
+			return e
+		}
+	case htmlEscapeStringType:
+		e.stringInstr(ptrHTMLEscapeStringToBuf)
+		return e
 	case escapeStringType:
-		e.stringInstr(ptrEscapeStringToBuf)
+		e.stringInstr(e.escapeConv(ptrEscapeStringToBuf))
+		return e
+	}
+
+	/// types which serialize themselves
+	if conv := marshalerInstr(e.tt.Elem(), e.opts); conv != nil {
+		e.convInstr(conv)
 		return e
 	}
 
@@ -51,18 +114,50 @@ func NewSliceEncoder(t interface{}) *SliceEncoder {
 	case reflect.Struct:
 		e.structInstr()
 
+	case reflect.Map:
+		e.mapInstr()
+
+	case reflect.Array:
+		e.convInstr(typeInstr(e.tt.Elem(), e.opts))
+
+	case reflect.Interface:
+		e.interfaceInstr()
+
 	case reflect.String:
-		e.stringInstr(ptrStringToBuf)
+		e.stringInstr(e.escapeConv(ptrStringToBuf))
 
 	case reflect.Ptr:
 
 		/// which pointer type
 		switch e.tt.Elem().Elem() {
 		case timeType:
+			if e.opts.time != (timeFormat{}) {
+				e.ptrConvInstr(timeInstr(e.opts.time))
+				return e
+			}
 			e.ptrTimeInstr()
 			return e
+		case durationType:
+			if e.opts.duration != durationNanos {
+				e.ptrConvInstr(durationInstr(e.opts.duration))
+				return e
+			}
+		case htmlEscapeStringType:
+			e.ptrStringInstr(ptrHTMLEscapeStringToBuf)
+			return e
 		case escapeStringType:
-			e.ptrStringInstr(ptrEscapeStringToBuf)
+			e.ptrStringInstr(e.escapeConv(ptrEscapeStringToBuf))
+			return e
+		}
+
+		if conv := marshalerInstr(e.tt.Elem().Elem(), e.opts); conv != nil {
+			e.ptrConvInstr(conv)
+			return e
+		}
+
+		/// guarded pointers go through ptrConvInstr, which adds the checks
+		if e.opts.maxDepth > 0 || e.opts.detectCycles {
+			e.ptrConvInstr(typeInstr(e.tt.Elem().Elem(), e.opts))
 			return e
 		}
 
@@ -73,8 +168,14 @@ func NewSliceEncoder(t interface{}) *SliceEncoder {
 		case reflect.Struct:
 			e.ptrStrctInstr()
 
+		case reflect.Map:
+			e.ptrMapInstr()
+
+		case reflect.Array, reflect.Ptr:
+			e.ptrConvInstr(typeInstr(e.tt.Elem().Elem(), e.opts))
+
 		case reflect.String:
-			e.ptrStringInstr(ptrStringToBuf)
+			e.ptrStringInstr(e.escapeConv(ptrStringToBuf))
 
 		default:
 			e.ptrOtherInstr()
@@ -87,6 +188,14 @@ func NewSliceEncoder(t interface{}) *SliceEncoder {
 	return e
 }
 
+// escapeConv swaps conv for html escaping when the encoder has been asked to escape all strings that way
+func (e *SliceEncoder) escapeConv(conv func(unsafe.Pointer, *Buffer)) func(unsafe.Pointer, *Buffer) {
+	if e.opts.escapeHTML {
+		return ptrHTMLEscapeStringToBuf
+	}
+	return conv
+}
+
 // // avoid allocs in the instruction
 var (
 	null = []byte("null")
@@ -102,14 +211,14 @@ type sliceHeader struct {
 }
 
 func (e *SliceEncoder) sliceInstr() {
-	enc := NewSliceEncoder(reflect.New(e.tt.Elem()).Elem().Interface())
+	enc := newSliceEncoder(reflect.New(e.tt.Elem()).Elem().Interface(), e.opts)
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 			s := unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))
 			enc.Marshal(s, w)
@@ -120,14 +229,32 @@ func (e *SliceEncoder) sliceInstr() {
 }
 
 func (e *SliceEncoder) structInstr() {
-	enc := NewStructEncoder(reflect.New(e.tt.Elem()).Elem().Interface())
+	enc := newStructEncoder(reflect.New(e.tt.Elem()).Elem().Interface(), e.opts)
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*sliceHeader)(v)
+		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if i > zero {
+				w.separate()
+			}
+			s := unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))
+			enc.Marshal(s, w)
+		}
+
+		w.WriteByte(']')
+	}
+}
+
+func (e *SliceEncoder) mapInstr() {
+	enc := newMapEncoder(reflect.New(e.tt.Elem()).Elem().Interface(), e.opts)
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 			s := unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))
 			enc.Marshal(s, w)
@@ -167,8 +294,44 @@ func (e *SliceEncoder) otherInstr() {
 
 	conv, ok := typeconv[e.tt.Elem().Kind()]
 	if !ok {
-		return
+		unsupported(e.tt.Elem(), e.opts, "no JSON representation for kind "+e.tt.Elem().Kind().String())
+	}
+
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*sliceHeader)(v)
+		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if i > zero {
+				w.separate()
+			}
+			conv(unsafe.Pointer(uintptr(sl.Data)+(i*e.offset)), w)
+		}
+
+		w.WriteByte(']')
+	}
+}
+
+// convInstr writes each element with conv, which is left to do any quoting itself
+func (e *SliceEncoder) convInstr(conv func(unsafe.Pointer, *Buffer)) {
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*sliceHeader)(v)
+		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if i > zero {
+				w.separate()
+			}
+			conv(unsafe.Pointer(uintptr(sl.Data)+(i*e.offset)), w)
+		}
+
+		w.WriteByte(']')
 	}
+}
+
+func (e *SliceEncoder) interfaceInstr() {
+
+	conv := ifaceInstr(e.tt.Elem(), e.opts)
 
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
@@ -176,7 +339,7 @@ func (e *SliceEncoder) otherInstr() {
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 			conv(unsafe.Pointer(uintptr(sl.Data)+(i*e.offset)), w)
 		}
@@ -192,7 +355,7 @@ func (e *SliceEncoder) timeInstr() {
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 			w.WriteByte('"')
 			ptrTimeToBuf(unsafe.Pointer(uintptr(sl.Data)+(i*e.offset)), w)
@@ -204,14 +367,14 @@ func (e *SliceEncoder) timeInstr() {
 }
 
 func (e *SliceEncoder) ptrSliceInstr() {
-	enc := NewSliceEncoder(reflect.New(e.tt.Elem()).Elem().Elem().Interface())
+	enc := newSliceEncoder(reflect.New(e.tt.Elem().Elem()).Elem().Interface(), e.opts)
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 
 			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
@@ -227,14 +390,37 @@ func (e *SliceEncoder) ptrSliceInstr() {
 }
 
 func (e *SliceEncoder) ptrStrctInstr() {
-	enc := NewStructEncoder(reflect.New(e.tt.Elem().Elem()).Elem().Interface())
+	enc := newStructEncoder(reflect.New(e.tt.Elem().Elem()).Elem().Interface(), e.opts)
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*sliceHeader)(v)
+		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if i > zero {
+				w.separate()
+			}
+
+			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
+			if s == unsafe.Pointer(nil) {
+				w.Write(null)
+				continue
+			}
+			enc.Marshal(s, w)
+		}
+
+		w.WriteByte(']')
+	}
+}
+
+func (e *SliceEncoder) ptrMapInstr() {
+	enc := newMapEncoder(reflect.New(e.tt.Elem().Elem()).Elem().Interface(), e.opts)
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 
 			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
@@ -256,7 +442,7 @@ func (e *SliceEncoder) ptrStringInstr(conv func(unsafe.Pointer, *Buffer)) {
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 
 			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
@@ -277,16 +463,40 @@ func (e *SliceEncoder) ptrOtherInstr() {
 
 	conv, ok := typeconv[e.tt.Elem().Elem().Kind()]
 	if !ok {
-		return
+		unsupported(e.tt.Elem().Elem(), e.opts, "no JSON representation for kind "+e.tt.Elem().Elem().Kind().String())
+	}
+
+	e.instruction = func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('[')
+
+		sl := *(*sliceHeader)(v)
+		for i := uintptr(0); i < uintptr(sl.Len); i++ {
+			if i > zero {
+				w.separate()
+			}
+
+			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
+			if s == unsafe.Pointer(nil) {
+				w.Write(null)
+				continue
+			}
+			conv(s, w)
+		}
+
+		w.WriteByte(']')
 	}
+}
 
+// ptrConvInstr is the equivalent of convInstr for pointer elements
+func (e *SliceEncoder) ptrConvInstr(conv func(unsafe.Pointer, *Buffer)) {
+	conv = guardInstr(e.tt.Elem().Elem(), e.opts, conv)
 	e.instruction = func(v unsafe.Pointer, w *Buffer) {
 		w.WriteByte('[')
 
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 
 			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
@@ -308,7 +518,7 @@ func (e *SliceEncoder) ptrTimeInstr() {
 		sl := *(*sliceHeader)(v)
 		for i := uintptr(0); i < uintptr(sl.Len); i++ {
 			if i > zero {
-				w.WriteByte(',')
+				w.separate()
 			}
 
 			s := unsafe.Pointer(*(*unsafe.Pointer)(unsafe.Pointer(uintptr(sl.Data) + (i * e.offset))))
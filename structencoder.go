@@ -24,6 +24,9 @@ type instruction struct {
 	offset  uintptr                       // used in conjunction with leapFun
 	leapFun func(unsafe.Pointer, *Buffer) // provides a fast path for simple write & avoids wrapping function to capture offset
 	fun     func(unsafe.Pointer, *Buffer) // full instruction function for when the approaches above fail
+	empty   func(unsafe.Pointer) bool     // used in conjunction with offset by kindOmitEmpty to test the field
+	skip    int                           // number of instructions kindOmitEmpty and kindEmbedded jump over when skipping a field
+	ptrs    []uintptr                     // embedded struct pointers kindEmbedded follows to find a promoted field
 }
 
 const (
@@ -31,6 +34,10 @@ const (
 	kindStringField
 	kindStatic
 	kindInt
+	kindOmitEmpty
+	kindSep
+	kindEmbedded
+	kindEmbeddedEnd
 )
 
 // iface describes the memory footprint of interface{}
@@ -41,12 +48,15 @@ type iface struct {
 // StructEncoder stores a set of instructions for converting a struct to a json document. It's
 // useless to create an instance of this outside of `NewStructEncoder`.
 type StructEncoder struct {
+	opts         options             // options the encoder was created with
 	instructions []instruction       // the instructionset to be executed during Marshal
 	f            reflect.StructField // current field
 	t            interface{}         // type
 	i            int                 // iter
 	cb           Buffer              // side buffer for static data
 	cpos         int                 // side buffer position
+	emit         int                 // number of fields emitted so far
+	fixed        bool                // whether we've emitted a field which is always written, i.e not omitempty
 }
 
 // Marshal executes the instructions for a given type and writes the resulting
@@ -55,6 +65,9 @@ func (e *StructEncoder) Marshal(s interface{}, w *Buffer) {
 
 	p := (*(*iface)(unsafe.Pointer(&s))).Data
 
+	wrote := false // only consulted by kindSep, i.e. structs which lead with omitempty fields
+	root := p      // p moves to embedded structs for the fields promoted from them, root remains our struct
+
 	for i := 0; i < len(e.instructions); i++ {
 
 		if e.instructions[i].kind == kindStatic { // static data fast path
@@ -69,90 +82,264 @@ func (e *StructEncoder) Marshal(s interface{}, w *Buffer) {
 		} else if e.instructions[i].leapFun != nil { // simple 'conv' function fast path
 			e.instructions[i].leapFun(unsafe.Pointer(uintptr(p)+e.instructions[i].offset), w)
 			continue
+		} else if e.instructions[i].kind == kindOmitEmpty { // skip the key and value of empty omitempty fields
+			if e.instructions[i].empty(unsafe.Pointer(uintptr(p) + e.instructions[i].offset)) {
+				i += e.instructions[i].skip
+			}
+			continue
+		} else if e.instructions[i].kind == kindSep { // separator which can't be known until runtime
+			if wrote {
+				w.WriteByte(',')
+			}
+			wrote = true
+			continue
+		} else if e.instructions[i].kind == kindEmbedded { // move to the embedded struct a field is promoted from
+			for _, off := range e.instructions[i].ptrs {
+				if p = *(*unsafe.Pointer)(unsafe.Pointer(uintptr(p) + off)); p == nil {
+					break
+				}
+			}
+			if p == nil { // nil embedded struct pointers skip the field entirely
+				p = root
+				i += e.instructions[i].skip
+			}
+			continue
+		} else if e.instructions[i].kind == kindEmbeddedEnd {
+			p = root
+			continue
 		}
 
 		e.instructions[i].fun(p, w) // all other instruction types
 	}
 }
 
+// MarshalE is Marshal, but stops at the first error returned by a JSONEncoderE or JSONMarshalerE field, or by
+// MarshalJSON or MarshalText, and returns it as a *MarshalerError. It also returns an *UnsupportedTypeError for any type found in an interface which can't be
+// encoded, rather than panicking. Whatever was written up to that point is left in the buffer.
+func (e *StructEncoder) MarshalE(s interface{}, w *Buffer) error {
+	return marshalE(w, func() { e.Marshal(s, w) })
+}
+
 // NewStructEncoder compiles a set of instructions for marhsaling a struct shape to a JSON document.
-func NewStructEncoder(t interface{}) *StructEncoder {
-	e := &StructEncoder{}
-	e.t = t
+// It panics with an *UnsupportedTypeError if a field can't be encoded.
+func NewStructEncoder(t interface{}, opts ...Option) *StructEncoder {
+	return newStructEncoder(t, newOptions(opts))
+}
+
+// NewStructEncoderE is NewStructEncoder, but returns an *UnsupportedTypeError rather than panicking.
+func NewStructEncoderE(t interface{}, opts ...Option) (enc *StructEncoder, err error) {
+	defer recoverUnsupported(&err)
+	return newStructEncoder(t, newOptions(opts)), nil
+}
+
+func newStructEncoder(t interface{}, o options) *StructEncoder {
 	tt := reflect.TypeOf(t)
+	o.time, o.duration = timeFormat{}, durationNanos // the options of the field we're nested in don't apply to our own fields
+
+	/// recursive types share the encoder already being compiled for them
+	if enc, ok := sharedEncoder(tt, &o); ok {
+		return enc.(*StructEncoder)
+	}
+
+	e := &StructEncoder{opts: o}
+	e.t = t
+	defer share(tt, o, e)()
 
 	e.chunk("{")
 
-	emit := 0 // track number of fields we emit
-	// pass over each field in the struct to build up our instruction set for each
-	for e.i = 0; e.i < tt.NumField(); e.i++ {
-		e.f = tt.Field(e.i)
+	if e.opts.path == "" {
+		e.opts.path = tt.Name()
+	}
 
-		tag, opts := parseTag(e.f.Tag.Get("json")) // we're using tags to nominate inclusion
-		if tag == "" {
+	// pass over each field in the struct to build up our instruction set for each
+	base := e.opts
+	fields := typeFields(tt, e.opts) // we're using tags to nominate inclusion, unless told otherwise
+	for e.i = 0; e.i < len(fields); e.i++ {
+		e.f = fields[e.i].sf
+		e.opts = base
+		e.opts.path = joinPath(base.path, e.f.Name) // nested encoders report errors from this field
+
+		/// fields of unsupported types can opt to be left out, rather than fail the whole encoder
+		if fields[e.i].opts.Contains("skipunsupported") {
+			e.skippable(fields[e.i])
 			continue
 		}
-		emit++
+		e.field(fields[e.i])
+	}
+	e.opts = base
 
-		// write the key
-		if emit > 1 {
-			e.chunk(",")
-		}
-		e.chunk(`"` + tag + `":`)
+	e.chunk("}")
+	e.flunk()
 
-		switch {
-		/// support calling .String() when the 'stringer' option is passed
-		case opts.Contains("stringer") && reflect.ValueOf(e.t).Field(e.i).MethodByName("String").Kind() != reflect.Invalid:
-			e.optInstrStringer()
+	return e
+}
 
-		/// support calling .JSONEncode(*Buffer) when the 'encoder' option is passed
-		case opts.Contains("encoder"):
+// field compiles the instructions for writing a single field, key and all
+func (e *StructEncoder) field(f field) {
+	tag, opts := f.name, f.opts
+	e.emit++
 
-			// requrie explicit opt-in for JSONMarshaler implementation
-			t := reflect.ValueOf(e.t).Field(e.i).Type()
-			if t.Kind() != reflect.Ptr {
-				t = reflect.PtrTo(t)
-			}
+	e.opts.time = parseTimeFormat(opts, e.opts)
+	e.opts.duration = parseDurationFormat(opts, e.opts)
 
-			if _, ok := t.MethodByName("EncodeJSON"); ok {
-				e.optInstrEncoderWriter()
-				break
-			}
+	/// fields promoted from embedded struct pointers are read from the embedded struct, and skipped if it's nil
+	promoted := len(f.ptrs) > 0
+	embed := 0
+	if promoted {
+		e.flunk()
+		embed = len(e.instructions)
+		e.instructions = append(e.instructions, instruction{kind: kindEmbedded, ptrs: f.ptrs})
+	}
 
-			// default to JSONEncoder implementation for any other encoder fields
-			e.optInstrEncoder()
+	/// omitempty fields are guarded by an instruction which skips the rest of the field when it's empty
+	omit := opts.Contains("omitempty")
+	guard := 0
+	if omit {
+		e.flunk()
+		guard = len(e.instructions)
+		e.instructions = append(e.instructions, instruction{kind: kindOmitEmpty, offset: e.f.Offset, empty: emptyFunc(e.f.Type, e.opts)})
+	}
 
-		/// support writing byteslice-like items using 'raw' option.
-		case opts.Contains("raw"):
-			e.optInstrRaw()
+	// write the key. until a field which is always written has been seen we can't know at compile
+	// time whether a separator is needed, so we leave that decision to a kindSep instruction.
+	switch {
+	case e.fixed:
+		e.chunk(",")
+	case e.emit > 1 || omit || promoted:
+		e.flunk()
+		e.instructions = append(e.instructions, instruction{kind: kindSep})
+	}
+	e.fixed = e.fixed || !(omit || promoted)
+	e.chunk(`"`)
+	if e.opts.escapeHTML { // keys are static, so we may as well make sure they're safe
+		htmlEscapeStringToBuf(tag, &e.cb)
+	} else {
+		escapeStringToBuf(tag, &e.cb)
+	}
+	e.chunk(`":`)
 
-		/// suport escaping reserved json characters from byteslice-like items and slices
-		case opts.Contains("escape"):
-			e.optInstrEscape()
+	switch {
+	/// support calling .String() when the 'stringer' option is passed
+	case opts.Contains("stringer") && hasMethod(e.f.Type, "String"):
+		e.optInstrStringer()
 
-		/// time is a type of struct, not a kind, so somewhat of a special case here.
-		case e.f.Type == timeType:
-			e.chunk(`"`)
-			e.val(ptrTimeToBuf)
-			e.chunk(`"`)
-		case e.f.Type.Kind() == reflect.Ptr && timeType == reflect.TypeOf(e.t).Field(e.i).Type.Elem():
-			e.ptrstringval(ptrTimeToBuf)
+	/// support calling .JSONEncode(*Buffer) when the 'encoder' option is passed
+	case opts.Contains("encoder"):
 
-		// write the value instruction depending on type
-		case e.f.Type.Kind() == reflect.Ptr:
-			// create an instruction which can read from a pointer field
-			e.valueInst(e.f.Type.Elem().Kind(), e.ptrval)
+		// requrie explicit opt-in for JSONMarshaler implementation
+		t := e.f.Type
+		if t.Kind() != reflect.Ptr {
+			t = reflect.PtrTo(t)
+		}
 
-		default:
-			// create an instruction which reads from a standard field
-			e.valueInst(e.f.Type.Kind(), e.val)
+		/// the error returning versions take priority
+		if t.Implements(jsonEncoderEType) {
+			e.optInstrEncoderE()
+			break
 		}
+		if t.Implements(jsonMarshalerEType) {
+			e.optInstrEncoderWriterE()
+			break
+		}
+
+		if _, ok := t.MethodByName("EncodeJSON"); ok {
+			e.optInstrEncoderWriter()
+			break
+		}
+
+		// default to JSONEncoder implementation for any other encoder fields
+		e.optInstrEncoder()
+
+	/// support writing byteslice-like items using 'raw' option.
+	case opts.Contains("raw"):
+		e.optInstrRaw()
+
+	/// suport escaping reserved json characters from byteslice-like items and slices
+	case (opts.Contains("htmlescape") || (opts.Contains("escape") && e.opts.escapeHTML)) && escapable(e.f.Type):
+		e.optInstrEscape(ptrHTMLEscapeStringToBuf, htmlEscapeStringType)
+
+	case opts.Contains("escape") && escapable(e.f.Type):
+		e.optInstrEscape(ptrEscapeStringToBuf, escapeStringType)
+
+	/// support quoting numbers and bools with the 'string' option, as the stdlib does
+	case opts.Contains("string") && quotable(e.f.Type):
+		e.optInstrString()
+
+	/// alternative encodings for byte slices, which are otherwise base64
+	case opts.Contains("hex") && isBytes(e.f.Type):
+		e.optInstrBytes(ptrHexToBuf)
+	case opts.Contains("base64url") && isBytes(e.f.Type):
+		e.optInstrBytes(ptrBase64URLToBuf)
+
+	/// conversions registered for the type come before any we'd pick
+	case typeEncoderFor(e.f.Type) != nil:
+		e.val(typeEncoderFor(e.f.Type))
+	case e.f.Type.Kind() == reflect.Ptr && typeEncoderFor(e.f.Type.Elem()) != nil:
+		e.ptrval(typeEncoderFor(e.f.Type.Elem()))
+
+	/// time is a type of struct, not a kind, so somewhat of a special case here.
+	case e.f.Type == timeType:
+		if e.opts.time != (timeFormat{}) {
+			e.val(timeInstr(e.opts.time))
+			break
+		}
+		e.chunk(`"`)
+		e.val(ptrTimeToBuf)
+		e.chunk(`"`)
+	case e.f.Type.Kind() == reflect.Ptr && timeType == e.f.Type.Elem():
+		if e.opts.time != (timeFormat{}) {
+			e.ptrval(timeInstr(e.opts.time))
+			break
+		}
+		e.ptrstringval(ptrTimeToBuf)
+
+	/// durations are only treated differently when they've asked to be
+	case e.opts.duration != durationNanos && e.f.Type == durationType:
+		e.val(durationInstr(e.opts.duration))
+	case e.opts.duration != durationNanos && e.f.Type.Kind() == reflect.Ptr && durationType == e.f.Type.Elem():
+		e.ptrval(durationInstr(e.opts.duration))
+
+	/// types which serialize themselves through json.Marshaler or encoding.TextMarshaler
+	case isMarshaler(e.f.Type):
+		e.optInstrMarshaler()
+
+	// write the value instruction depending on type
+	case e.f.Type.Kind() == reflect.Ptr:
+		// create an instruction which can read from a pointer field
+		e.valueInst(e.f.Type.Elem().Kind(), e.ptrval)
+
+	default:
+		// create an instruction which reads from a standard field
+		e.valueInst(e.f.Type.Kind(), e.val)
 	}
 
-	e.chunk("}")
-	e.flunk()
+	if omit {
+		e.flunk() // trailing chunk data belongs to this field, so needs to be skipped with it
+		e.instructions[guard].skip = len(e.instructions) - guard - 1
+	}
 
-	return e
+	if promoted {
+		e.flunk()
+		e.instructions[embed].skip = len(e.instructions) - embed - 1
+		e.instructions = append(e.instructions, instruction{kind: kindEmbeddedEnd})
+	}
+}
+
+// skippable compiles a field as field does, but should its type turn out to be unsupported then everything compiled
+// for it is rolled back, leaving it out of the document
+func (e *StructEncoder) skippable(f field) {
+	n, cb, cpos, emit, fixed := len(e.instructions), len(e.cb.Bytes), e.cpos, e.emit, e.fixed
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*UnsupportedTypeError); !ok {
+				panic(r)
+			}
+			e.instructions, e.cb.Bytes, e.cpos, e.emit, e.fixed = e.instructions[:n], e.cb.Bytes[:cb], cpos, emit, fixed
+		}
+	}()
+
+	e.field(f)
 }
 
 func (e *StructEncoder) appendInstructionFun(fun func(unsafe.Pointer, *Buffer)) {
@@ -162,7 +349,7 @@ func (e *StructEncoder) appendInstructionFun(fun func(unsafe.Pointer, *Buffer))
 func (e *StructEncoder) optInstrStringer() {
 	e.chunk(`"`)
 
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
+	t := e.f.Type
 	if e.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
@@ -185,7 +372,7 @@ func (e *StructEncoder) optInstrStringer() {
 }
 
 func (e *StructEncoder) optInstrEncoder() {
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
+	t := e.f.Type
 	if e.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
@@ -207,7 +394,7 @@ func (e *StructEncoder) optInstrEncoder() {
 }
 
 func (e *StructEncoder) optInstrEncoderWriter() {
-	t := reflect.ValueOf(e.t).Field(e.i).Type()
+	t := e.f.Type
 	if e.f.Type.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
@@ -228,7 +415,74 @@ func (e *StructEncoder) optInstrEncoderWriter() {
 	}
 }
 
+func (e *StructEncoder) optInstrMarshaler() {
+	if e.f.Type.Kind() == reflect.Ptr {
+		e.ptrval(marshalerInstr(e.f.Type.Elem(), e.opts))
+	} else {
+		e.val(marshalerInstr(e.f.Type, e.opts))
+	}
+}
+
+func (e *StructEncoder) optInstrBytes(conv func(unsafe.Pointer, *Buffer)) {
+	if e.f.Type.Kind() == reflect.Ptr {
+		e.ptrval(conv)
+	} else {
+		e.val(conv)
+	}
+}
+
+func (e *StructEncoder) optInstrEncoderE() {
+	t := e.f.Type
+	if e.f.Type.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	path := e.opts.path
+	conv := func(v unsafe.Pointer, w *Buffer) {
+		if err := reflect.NewAt(t, v).Interface().(JSONEncoderE).JSONEncodeE(w); err != nil {
+			w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+		}
+	}
+
+	if e.f.Type.Kind() == reflect.Ptr {
+		e.ptrval(conv)
+	} else {
+		e.val(conv)
+	}
+}
+
+func (e *StructEncoder) optInstrEncoderWriterE() {
+	t := e.f.Type
+	if e.f.Type.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	path := e.opts.path
+	conv := func(v unsafe.Pointer, w *Buffer) {
+		if err := reflect.NewAt(t, v).Interface().(JSONMarshalerE).EncodeJSONE(w); err != nil {
+			w.fail(&MarshalerError{Path: path, Type: t, Err: err})
+		}
+	}
+
+	if e.f.Type.Kind() == reflect.Ptr {
+		e.ptrval(conv)
+	} else {
+		e.val(conv)
+	}
+}
+
 func (e *StructEncoder) optInstrRaw() {
+
+	/// only strings and byte slices can hold raw JSON, anything else has nothing for us to write
+	t := e.f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.String && !isBytes(t) {
+		e.chunk("null")
+		return
+	}
+
 	conv := func(v unsafe.Pointer, w *Buffer) {
 		s := *(*string)(v)
 		if len(s) == 0 {
@@ -245,27 +499,103 @@ func (e *StructEncoder) optInstrRaw() {
 	}
 }
 
-func (e *StructEncoder) optInstrEscape() {
-	if e.f.Type.Kind() == reflect.Slice {
-		e.flunk()
+// optInstrEscape creates the instruction for fields using an escaping option. conv does the escaping for string
+// fields, and s is the equivalent string type to use for the strings held in anything else, e.g EscapeString
+func (e *StructEncoder) optInstrEscape(conv func(unsafe.Pointer, *Buffer), s reflect.Type) {
+	switch {
+	case e.f.Type.Kind() == reflect.String:
+		e.chunk(`"`)
+		e.val(conv)
+		e.chunk(`"`)
 
-		/// create an escape string encoder internally instead of mirroring the struct, so people only need to pass the ,escape opt instead
-		enc := NewSliceEncoder([]EscapeString{})
-		f := e.f
-		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-			var em interface{} = unsafe.Pointer(uintptr(v) + f.Offset)
-			enc.Marshal(em, w)
-		})
-		return
+	case e.f.Type.Kind() == reflect.Ptr && e.f.Type.Elem().Kind() == reflect.String:
+		e.ptrstringval(conv)
+
+	/// create an encoder for the equivalent escaping type internally instead of mirroring the struct, so people
+	/// only need to pass the ,escape opt instead
+	case e.f.Type.Kind() == reflect.Ptr:
+		t, _ := escapedType(e.f.Type, s, true)
+		e.ptrval(typeInstr(t.Elem(), e.opts))
+
+	default:
+		t, _ := escapedType(e.f.Type, s, true)
+		e.val(typeInstr(t, e.opts))
+	}
+}
+
+// escapable reports whether an escaping option applies to t, i.e it's a string or holds strings
+func escapable(t reflect.Type) bool {
+	_, ok := escapedType(t, escapeStringType, true)
+	return ok
+}
+
+// escapedType returns t with the strings it holds, behind pointers or in slices, arrays and maps, swapped for s. s has
+// the same layout as a string, so the result can be used to read the value in place. ok is false when t holds no
+// strings. Only top is allowed to be a named type, which rules out types which refer back to themselves.
+func escapedType(t, s reflect.Type, top bool) (_ reflect.Type, ok bool) {
+	if t.Kind() == reflect.String {
+		return s, true
+	}
+	if !top && t.Name() != "" {
+		return t, false
+	}
+
+	var elem reflect.Type
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		if elem, ok = escapedType(t.Elem(), s, false); !ok {
+			return t, false
+		}
+	default:
+		return t, false
 	}
 
+	switch t.Kind() {
+	case reflect.Ptr:
+		return reflect.PtrTo(elem), true
+	case reflect.Slice:
+		return reflect.SliceOf(elem), true
+	case reflect.Array:
+		return reflect.ArrayOf(t.Len(), elem), true
+	}
+	return reflect.MapOf(t.Key(), elem), true
+}
+
+func (e *StructEncoder) optInstrString() {
 	if e.f.Type.Kind() == reflect.Ptr {
-		e.ptrstringval(ptrEscapeStringToBuf)
-	} else {
-		e.chunk(`"`)
-		e.val(ptrEscapeStringToBuf)
-		e.chunk(`"`)
+		/// nil pointers stay as an unquoted null
+		e.ptrstringval(typeconv[e.f.Type.Elem().Kind()])
+		return
 	}
+
+	e.chunk(`"`)
+	e.val(typeconv[e.f.Type.Kind()])
+	e.chunk(`"`)
+}
+
+// quotable reports whether the `,string` option applies to t, or what t points to
+func quotable(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int,
+		reflect.Int8,
+		reflect.Int16,
+		reflect.Int32,
+		reflect.Int64,
+		reflect.Uint,
+		reflect.Uint8,
+		reflect.Uint16,
+		reflect.Uint32,
+		reflect.Uint64,
+		reflect.Float32,
+		reflect.Float64:
+		return true
+	}
+	return false
 }
 
 // chunk writes a chunk of body data to the chunk buffer. only for writing static
@@ -324,43 +654,43 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		instr(conv)
 
 	case reflect.Array:
-		/// support for primitives in arrays (proabbly need arrayencoder.go here if we want to take this further)
-		e.chunk("[")
 
-		conv, ok := typeconv[e.f.Type.Elem().Kind()]
-		if !ok {
-			return
+		t := e.f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
 		}
 
-		offset := e.f.Type.Elem().Size()
-		for i := 0; i < e.f.Type.Len(); i++ {
-			if i > 0 {
-				e.chunk(", ")
-			}
-
-			e.flunk()
-			f := e.f
-			i := i
-			e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-				conv(unsafe.Pointer(uintptr(v)+f.Offset+(uintptr(i)*offset)), w)
-			})
-		}
-
-		e.chunk("]")
+		enc := newArrayEncoder(reflect.New(t).Elem().Interface(), e.opts)
+		instr(func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		})
 
 	case reflect.Slice:
 
-		e.flunk()
+		/// byte slices are written as base64 strings, as the stdlib does
+		if isBytes(e.f.Type) {
+			instr(ptrBase64ToBuf)
+			return
+		}
 
-		enc := NewSliceEncoder(reflect.ValueOf(e.t).Field(e.i).Interface())
-		f := e.f
-		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
-			var em interface{} = unsafe.Pointer(uintptr(v) + f.Offset)
-			enc.Marshal(em, w)
+		t := e.f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		enc := newSliceEncoder(reflect.New(t).Elem().Interface(), e.opts)
+		instr(func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
 		})
 
 	case reflect.String:
 
+		/// html escaping across the whole encoder takes the place of all plain string writes
+		if e.opts.escapeHTML {
+			e.optInstrEscape(ptrHTMLEscapeStringToBuf, htmlEscapeStringType)
+			return
+		}
+
 		/// for strings to be nullable they need a special instruction to write quotes conditionally.
 		if e.f.Type.Kind() == reflect.Ptr {
 			e.ptrstringval(ptrStringToBuf)
@@ -382,14 +712,14 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		if e.f.Type.Kind() == reflect.Ptr {
 
 			/// now cater for it being a pointer to a struct
-			var inf = reflect.New(reflect.TypeOf(e.t).Field(e.i).Type.Elem()).Elem().Interface()
-
-			var enc *StructEncoder
-			if e.t == inf {
-				// handle recursive structs by re-using the current encoder
-				enc = e
-			} else {
-				enc = NewStructEncoder(inf)
+			enc := newStructEncoder(reflect.New(e.f.Type.Elem()).Elem().Interface(), e.opts)
+
+			/// guarded pointers go through ptrval, which adds the checks
+			if e.opts.maxDepth > 0 || e.opts.detectCycles {
+				e.ptrval(func(v unsafe.Pointer, w *Buffer) {
+					enc.Marshal(v, w)
+				})
+				return
 			}
 
 			// now create an instruction to marshal the field
@@ -406,7 +736,7 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		}
 
 		// build a new StructEncoder for the type
-		enc := NewStructEncoder(reflect.ValueOf(e.t).Field(e.i).Interface())
+		enc := newStructEncoder(reflect.New(e.f.Type).Elem().Interface(), e.opts)
 		// now create another instruction which calls marshal on the struct, passing our writer
 		f := e.f
 		e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
@@ -415,9 +745,38 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		})
 		return
 
+	case reflect.Map:
+
+		/// maps are pointer shaped, so the same instruction serves both plain and pointer fields
+		t := e.f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		enc := newMapEncoder(reflect.New(t).Elem().Interface(), e.opts)
+		instr(func(v unsafe.Pointer, w *Buffer) {
+			enc.Marshal(v, w)
+		})
+
+	case reflect.Interface:
+
+		/// the concrete type is resolved when we marshal
+		t := e.f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		instr(ifaceInstr(t, e.opts))
+
+	case reflect.Ptr:
+
+		/// pointers to pointers are followed as far as they go, and a nil at any of them is written as null
+		t := e.f.Type
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		instr(typeInstr(t, e.opts))
+
 	case reflect.Invalid,
-		reflect.Map,
-		reflect.Interface,
 		reflect.Complex64,
 		reflect.Complex128,
 		reflect.Chan,
@@ -425,7 +784,7 @@ func (e *StructEncoder) valueInst(k reflect.Kind, instr func(func(unsafe.Pointer
 		reflect.Uintptr,
 		reflect.UnsafePointer:
 		// no
-		panic(fmt.Sprint("unsupported type ", e.f.Type.Kind(), e.f.Name))
+		unsupported(e.f.Type, e.opts, "no JSON representation for kind "+k.String())
 	}
 }
 
@@ -444,6 +803,8 @@ func (e *StructEncoder) ptrval(conv func(unsafe.Pointer, *Buffer)) {
 	// avoids allocs at runtime
 	null := []byte("null")
 
+	conv = guardInstr(e.f.Type.Elem(), e.opts, conv)
+
 	f := e.f
 	e.appendInstructionFun(func(v unsafe.Pointer, w *Buffer) {
 
@@ -479,6 +840,12 @@ func (e *StructEncoder) ptrstringval(conv func(unsafe.Pointer, *Buffer)) {
 	})
 }
 
+// hasMethod reports whether the method set of t includes the named method
+func hasMethod(t reflect.Type, name string) bool {
+	_, ok := t.MethodByName(name)
+	return ok
+}
+
 // JSONEncoder works with the `.encoder` option. Fields can implement this to encode their own JSON string straight
 // into the working buffer. This can be useful if you're working with interface fields at runtime.
 type JSONEncoder interface {
@@ -492,6 +859,23 @@ type JSONMarshaler interface {
 	EncodeJSON(io.Writer)
 }
 
+// JSONEncoderE is JSONEncoder for implementations which can fail. It also works with the `,encoder` option, and any
+// error returned is passed back from MarshalE.
+type JSONEncoderE interface {
+	JSONEncodeE(*Buffer) error
+}
+
+// JSONMarshalerE is JSONMarshaler for implementations which can fail. It also works with the `,encoder` option, and any
+// error returned is passed back from MarshalE.
+type JSONMarshalerE interface {
+	EncodeJSONE(io.Writer) error
+}
+
+var (
+	jsonEncoderEType   = reflect.TypeOf((*JSONEncoderE)(nil)).Elem()
+	jsonMarshalerEType = reflect.TypeOf((*JSONMarshalerE)(nil)).Elem()
+)
+
 // tagOptions is the string following a comma in a struct field's "json"
 // tag, or the empty string. It does not include the leading comma.
 //
@@ -529,6 +913,23 @@ func (o tagOptions) Contains(optionName string) bool {
 	return false
 }
 
+// Value returns the value of a `key=value` option, and whether it was present.
+func (o tagOptions) Value(key string) (string, bool) {
+	s := string(o)
+	for s != "" {
+		var next string
+		i := strings.Index(s, ",")
+		if i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if len(s) > len(key) && s[len(key)] == '=' && s[:len(key)] == key {
+			return s[len(key)+1:], true
+		}
+		s = next
+	}
+	return "", false
+}
+
 var timeType = reflect.TypeOf(time.Time{})
 
 // EscapeString can be used to cast your string slice encoders in replacement of `[]string` when using SliceEncoder directly.
@@ -538,3 +939,9 @@ var timeType = reflect.TypeOf(time.Time{})
 type EscapeString string
 
 var escapeStringType = reflect.TypeOf(EscapeString(""))
+
+// HTMLEscapeString is the equivalent of EscapeString for the `,htmlescape` option, for use with SliceEncoder directly.
+// e.g var mySliceEncoder = NewSliceEncoder([]jingo.HTMLEscapeString{})
+type HTMLEscapeString string
+
+var htmlEscapeStringType = reflect.TypeOf(HTMLEscapeString(""))
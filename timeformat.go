@@ -0,0 +1,122 @@
+package jingo
+
+// timeformat.go supports the `,time=`, `,layout=` and `,utc` options, which change how a time is
+// written. The format is picked out of the tag once when compiling and carried down to the slice,
+// array and map encoders built for the field, so that their elements are written the same way.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// timeFormat is how a time is written. The zero value is the default, RFC 3339 with nanoseconds.
+type timeFormat struct {
+	unix   int    // when non-zero, times are written as a number in these units since the epoch
+	layout string // otherwise they're written as a string in this layout, or the default when empty
+	utc    bool   // times are converted to UTC first
+}
+
+// units for timeFormat.unix
+const (
+	unixSeconds = iota + 1
+	unixMillis
+	unixNanos
+)
+
+// named layouts for `,time=`. these cover the common layouts which couldn't be given through `,layout=`
+// as they contain commas
+var timeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+}
+
+// parseTimeFormat reads the time format from a field's tag options
+func parseTimeFormat(opts tagOptions, o options) timeFormat {
+	var f timeFormat
+
+	if name, ok := opts.Value("time"); ok {
+		switch name {
+		case "unix":
+			f.unix = unixSeconds
+		case "unixmilli":
+			f.unix = unixMillis
+		case "unixnano":
+			f.unix = unixNanos
+		default:
+			layout, ok := timeLayouts[name]
+			if !ok {
+				unsupported(timeType, o, "unknown time format "+strconv.Quote(name))
+			}
+			f.layout = layout
+		}
+	}
+
+	if layout, ok := opts.Value("layout"); ok {
+		f.layout = spacedLayout(layout)
+	}
+
+	f.utc = opts.Contains("utc")
+
+	return f
+}
+
+// spacedLayout reads the underscores in a `,layout=` as spaces, as go vet won't accept spaces in struct tags. The
+// underscore in the _2 layout element is left as it is, so __2 is a space followed by _2, but _2006 is a space
+// followed by the year.
+func spacedLayout(layout string) string {
+	if !strings.Contains(layout, "_") {
+		return layout
+	}
+
+	b := []byte(layout)
+	for i := range b {
+		if b[i] == '_' && (!strings.HasPrefix(layout[i:], "_2") || strings.HasPrefix(layout[i:], "_2006")) {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// timeInstr creates the instruction for writing the time found at a pointer in the format f.
+// Numbers are written as they are, everything else is quoted.
+func timeInstr(f timeFormat) func(unsafe.Pointer, *Buffer) {
+
+	read := func(v unsafe.Pointer) time.Time {
+		return *(*time.Time)(v)
+	}
+	if f.utc {
+		read = func(v unsafe.Pointer) time.Time {
+			return (*time.Time)(v).UTC()
+		}
+	}
+
+	switch f.unix {
+	case unixSeconds:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.Bytes = strconv.AppendInt(w.Bytes, read(v).Unix(), 10)
+		}
+	case unixMillis:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.Bytes = strconv.AppendInt(w.Bytes, read(v).UnixMilli(), 10)
+		}
+	case unixNanos:
+		return func(v unsafe.Pointer, w *Buffer) {
+			w.Bytes = strconv.AppendInt(w.Bytes, read(v).UnixNano(), 10)
+		}
+	}
+
+	layout := f.layout
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+
+	return func(v unsafe.Pointer, w *Buffer) {
+		w.WriteByte('"')
+		w.Bytes = read(v).AppendFormat(w.Bytes, layout)
+		w.WriteByte('"')
+	}
+}